@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+// tokenBucket limits a bandwidth in bytes per second, with bursts of up to one second of traffic
+type tokenBucket struct {
+	rate   float64 // Bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// allow takes n bytes from the bucket if they are available. If force is set, they are taken anyway:
+// the bucket goes into debt, which delays the next messages.
+func (b *tokenBucket) allow(n int, now time.Time, force bool) bool {
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < float64(n) && !force {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
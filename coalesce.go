@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bezineb5/go-h264-streamer/stream"
+)
+
+// coalescer batches consecutive NAL units of an access unit into a single message
+type coalescer struct {
+	window   time.Duration
+	maxBytes int
+
+	batch    []byte
+	nalType  uint8 // Type of the slices of the batch, or of its last unit if it has none
+	hasSlice bool
+	deadline <-chan time.Time // Fires when the batch must be sent, nil without batch
+}
+
+// add appends a NAL unit to the batch. It returns the batch to send first if the unit starts a new access unit
+// or doesn't fit, and the batch to send after it if it is full.
+func (c *coalescer) add(nal []byte, nalType uint8, clock stream.Clock) (before, after *batch) {
+	if len(c.batch) > 0 && ((c.hasSlice && stream.StartsAccessUnit(nal)) || len(c.batch)+len(nal) > c.maxBytes) {
+		before = c.flush()
+	}
+	if len(c.batch) == 0 {
+		c.deadline = clock.After(c.window)
+	}
+	c.batch = append(c.batch, nal...)
+	if isSlice(nalType) || nalType == stream.NALTypeIDR {
+		c.nalType = nalType
+		c.hasSlice = true
+	} else if !c.hasSlice {
+		c.nalType = nalType
+	}
+	if len(c.batch) >= c.maxBytes {
+		after = c.flush()
+	}
+	return before, after
+}
+
+// flush returns the batch and starts a new one
+func (c *coalescer) flush() *batch {
+	if len(c.batch) == 0 {
+		return nil
+	}
+	b := &batch{data: c.batch, nalType: c.nalType}
+	c.batch = nil
+	c.hasSlice = false
+	c.deadline = nil
+	return b
+}
+
+// batch is a message made of one or more NAL units
+type batch struct {
+	data    []byte
+	nalType uint8
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bezineb5/go-h264-streamer/stream"
+)
+
+func TestCoalescerSplitsAccessUnits(t *testing.T) {
+	clock := stream.NewManualClock(testEpoch)
+	c := &coalescer{window: time.Second, maxBytes: 1024}
+	sps, pps := testNAL(stream.NALTypeSPS, 0x42), testNAL(stream.NALTypePPS, 0xce)
+	idr := testNAL(stream.NALTypeIDR, 1)
+	idrNext := []byte{0, 0, 0, 1, 0x65, 0x40, 2} // Second slice of the picture
+	slice := testNAL(stream.NALTypeSlice, 3)
+
+	var sent [][]byte
+	for _, nal := range [][]byte{sps, pps, idr, idrNext, slice} {
+		before, after := c.add(nal, stream.NALType(nal), clock)
+		for _, b := range []*batch{before, after} {
+			if b != nil {
+				sent = append(sent, b.data)
+			}
+		}
+	}
+	if b := c.flush(); b != nil {
+		sent = append(sent, b.data)
+	}
+
+	// The parameter sets go with the keyframe, and its slices together
+	want := [][]byte{bytes.Join([][]byte{sps, pps, idr, idrNext}, nil), slice}
+	if len(sent) != len(want) {
+		t.Fatalf("%d batches sent, want %d: %x", len(sent), len(want), sent)
+	}
+	for i := range want {
+		if !bytes.Equal(sent[i], want[i]) {
+			t.Errorf("batch %d = %x, want %x", i, sent[i], want[i])
+		}
+	}
+}
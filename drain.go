@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Shutdown stops accepting connections, and closes the current ones once the messages queued for them are sent,
+// for at most DrainTimeout. It returns when all the connections are closed, or the error of ctx if it is done first.
+func (wsh *webSocketHandler) Shutdown(ctx context.Context) error {
+	wsh.shutdownMutex.Lock()
+	if !wsh.shuttingDown {
+		wsh.shuttingDown = true
+		close(wsh.closing)
+	}
+	wsh.shutdownMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		wsh.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track counts a new connection, so that Shutdown waits for it. It returns false once shutting down:
+// the connection must then be refused. Otherwise untrack must be called when the connection ends.
+func (wsh *webSocketHandler) track() bool {
+	wsh.shutdownMutex.Lock()
+	defer wsh.shutdownMutex.Unlock()
+
+	if wsh.shuttingDown {
+		return false
+	}
+	wsh.active.Add(1)
+	return true
+}
+
+func (wsh *webSocketHandler) untrack() {
+	wsh.active.Done()
+}
+
+// drainDeadline returns the deadline of the writes of the messages still queued when shutting down,
+// or false if they are not sent. It is a network deadline: it is taken from the wall clock, not from the clock of the handler.
+func (wsh *webSocketHandler) drainDeadline() (time.Time, bool) {
+	if wsh.options.DrainTimeout <= 0 {
+		return time.Time{}, false
+	}
+	return time.Now().Add(wsh.options.DrainTimeout), true
+}
+
+// drain writes the messages queued for the connection, until one fails. The caller bounds the writes with a deadline.
+func (c *connection) drain(write func(msg []byte) error) {
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return
+			}
+			if err := write(msg); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bezineb5/go-h264-streamer/stream"
+)
+
+func TestDrainDeadlineUsesWallClock(t *testing.T) {
+	// The clock of the handler is far from the wall clock
+	wsh := newTestHub(t, WebSocketOptions{Clock: stream.NewManualClock(testEpoch), DrainTimeout: time.Second})
+
+	before := time.Now()
+	deadline, ok := wsh.drainDeadline()
+	if !ok {
+		t.Fatal("no drain deadline with a drain timeout")
+	}
+	if deadline.Before(before.Add(time.Second)) || deadline.After(time.Now().Add(time.Second)) {
+		t.Errorf("drain deadline %v, want a second after %v", deadline, before)
+	}
+
+	wsh = newTestHub(t, WebSocketOptions{})
+	if _, ok := wsh.drainDeadline(); ok {
+		t.Error("drain deadline without a drain timeout")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/bezineb5/go-h264-streamer/stream"
+)
+
+const frameMetaQueueSize = 64
+
+// FrameMeta describes an access unit of the stream, e.g. to compute the bitrate, frame rate or GOP externally
+type FrameMeta struct {
+	Sequence  uint64    // Number of the access unit, from 1
+	NALType   uint8     // Type of its slices: NALTypeIDR for a keyframe, NALTypeSlice otherwise
+	Keyframe  bool      // True if decoding can start from it
+	Size      int       // Size in bytes of its NAL units, with their start codes
+	Units     int       // Number of NAL units, including parameter sets and SEI
+	Timestamp time.Time // Reception of its first unit
+	Payload   []byte    // Its NAL units, only if WebSocketOptions.FramePayload is set
+}
+
+// frameMeter groups the broadcast NAL units into access units and hands their metadata to a listener,
+// through a bounded queue so that a slow listener can't delay the broadcast: the metadata which doesn't fit is dropped
+type frameMeter struct {
+	payload bool
+
+	current  FrameMeta
+	hasSlice bool
+	sequence uint64
+	queue    chan FrameMeta
+	dropped  atomic.Uint64
+}
+
+func newFrameMeter(listener func(FrameMeta), payload bool) *frameMeter {
+	m := &frameMeter{payload: payload, queue: make(chan FrameMeta, frameMetaQueueSize)}
+	go func() {
+		for meta := range m.queue {
+			listener(meta)
+		}
+	}()
+	return m
+}
+
+// add accounts a NAL unit. An access unit is reported when the next one begins, as its end isn't marked.
+func (m *frameMeter) add(nal []byte, nalType uint8, now time.Time) {
+	if m.hasSlice && stream.StartsAccessUnit(nal) {
+		m.report()
+	}
+	if m.current.Units == 0 {
+		m.current.Timestamp = now
+	}
+	m.current.Units++
+	m.current.Size += len(nal)
+	if m.payload {
+		m.current.Payload = append(m.current.Payload, nal...)
+	}
+	if isSlice(nalType) || nalType == stream.NALTypeIDR {
+		m.current.NALType = nalType
+		m.current.Keyframe = nalType == stream.NALTypeIDR
+		m.hasSlice = true
+	}
+}
+
+// report queues the metadata of the current access unit, and starts the next one
+func (m *frameMeter) report() {
+	m.sequence++
+	m.current.Sequence = m.sequence
+	select {
+	case m.queue <- m.current:
+	default:
+		dropped := m.dropped.Add(1)
+		slog.Debug("frameMeter: Listener too slow; dropping frame metadata", slog.Uint64("dropped", dropped))
+	}
+	m.current = FrameMeta{}
+	m.hasSlice = false
+}
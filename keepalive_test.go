@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bezineb5/go-h264-streamer/stream"
+	"github.com/gorilla/websocket"
+)
+
+// dialTestWebsocket returns the server and client ends of a websocket
+func dialTestWebsocket(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- ws
+	}))
+	t.Cleanup(httpServer.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-conns
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+func TestKeepAlive(t *testing.T) {
+	const timeout = 10 * time.Second
+
+	for _, tt := range []struct {
+		name         string
+		answersPings bool
+	}{
+		{"answering client", true},
+		{"silent client", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := dialTestWebsocket(t)
+			if tt.answersPings {
+				// Reading answers the pings
+				go func() {
+					for {
+						if _, _, err := client.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			clock := stream.NewManualClock(time.Now())
+			c := &connection{ws: server, send: make(chan []byte, 1)}
+			done := make(chan struct{})
+			defer close(done)
+			c.keepAlive(timeout, clock, done)
+			errCh := make(chan bool, 1)
+			go c.reader(errCh)
+
+			for i := 0; i < 4; i++ {
+				clock.Advance(timeout / 2)
+				if !tt.answersPings {
+					continue
+				}
+				// Wait for the pong to the ping of this tick
+				deadline := time.Now().Add(receiveTimeout)
+				for c.lastPong.Load() != clock.Now().UnixNano() {
+					if time.Now().After(deadline) {
+						t.Fatalf("no pong to ping %d", i+1)
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+
+			if tt.answersPings {
+				select {
+				case <-errCh:
+					t.Fatal("answering client disconnected")
+				default:
+				}
+				return
+			}
+			select {
+			case <-errCh:
+			case <-time.After(receiveTimeout):
+				t.Fatal("silent client not disconnected")
+			}
+			if !c.pongTimedOut.Load() {
+				t.Error("disconnection not attributed to the missing pong")
+			}
+		})
+	}
+}
@@ -1,27 +1,60 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/bezineb5/go-h264-streamer/static"
 	"github.com/bezineb5/go-h264-streamer/stream"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
 const (
-	staticDir         = "static"
 	staticURL         = "/static"
 	videoWebsocketURL = "/stream"
+	videoSSEURL       = "/stream/sse"
+	statsURL          = "/stats"
+	infoURL           = "/info"
+	snapshotURL       = "/snapshot.jpg"
 	port              = 8080
 	width             = 960
 	height            = 540
 	fps               = 30
+
+	drainTimeout    = 2 * time.Second
+	shutdownTimeout = 5 * time.Second
 )
 
 func main() {
+	dumpPath := flag.String("dump", "", "Also write the raw H264 stream to this file, or to stdout if \"-\", e.g. to inspect it with ffprobe")
+	alwaysOn := flag.Bool("always-on", false, "Keep the camera running without clients, e.g. to record the stream continuously with -dump")
+	dumpTypes := flag.String("dump-nal-types", "", "Comma-separated NAL unit types written to the dump, e.g. \"7,8,5\" for keyframes only. All types if empty.")
+	tcpAddr := flag.String("tcp", "", "Also serve the raw H264 stream to TCP clients on this address, e.g. \":8081\" for gstreamer's tcpclientsrc")
+	dropSEI := flag.Bool("drop-sei", false, "Don't send the SEI NAL units to the clients, for decoders which choke on them. The dump keeps them.")
+	placeholderPath := flag.String("placeholder", "", "H264 file of a picture shown to clients until the camera produces one, e.g. a black frame")
+	tlsCert := flag.String("tls-cert", "", "Serve over HTTPS with this PEM certificate; requires -tls-key")
+	tlsKey := flag.String("tls-key", "", "PEM private key of the -tls-cert certificate")
+	clientCA := flag.String("client-ca", "", "Require client certificates signed by the authorities of this PEM file; requires -tls-cert")
+	flag.Parse()
+	if (*tlsCert == "") != (*tlsKey == "") || (*clientCA != "" && *tlsCert == "") {
+		log.Fatal("-tls-cert and -tls-key must be set together, and -client-ca requires them")
+	}
+
 	options := stream.CameraOptions{
 		Width:          width,
 		Height:         height,
@@ -32,16 +65,148 @@ func main() {
 		UseLibcamera:   false,
 	}
 
+	var tlsConfig *tls.Config
+	if *clientCA != "" {
+		var err error
+		tlsConfig, err = ClientCertTLSConfig(*clientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	router := mux.NewRouter()
 
 	// Websocket
 	connectionNumber := make(chan int, 2)
-	wsh := NewWebSocketHandler(connectionNumber)
+	wsOptions := WebSocketOptions{
+		Metadata:     NewStreamMetadata(options),
+		DropSEI:      *dropSEI,
+		DrainTimeout: drainTimeout,
+
+		RequireClientCert: tlsConfig != nil,
+	}
+	if *placeholderPath != "" {
+		placeholder, err := stream.LoadPlaceholder(*placeholderPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		wsOptions.Placeholder = placeholder
+	}
+	wsh := NewWebSocketHandler(connectionNumber, wsOptions)
 	router.HandleFunc(videoWebsocketURL, wsh.Handler)
-	go stream.Video(options, wsh, connectionNumber)
+	router.HandleFunc(videoSSEURL, wsh.SSEHandler)
+	if *tcpAddr != "" {
+		listener, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tlsConfig != nil {
+			// The TCP clients must present a certificate too
+			certificate, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			tcpConfig := tlsConfig.Clone()
+			tcpConfig.Certificates = []tls.Certificate{certificate}
+			listener = tls.NewListener(listener, tcpConfig)
+		}
+		go func() {
+			if err := wsh.ServeTCP(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	var writer io.Writer = wsh
+	if *dumpPath != "" {
+		dump, err := openDump(*dumpPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer dump.Close()
+		var dumpWriter io.Writer = &stoppingWriter{writer: dump}
+		if *dumpTypes != "" {
+			types, err := parseNALTypes(*dumpTypes)
+			if err != nil {
+				log.Fatal(err)
+			}
+			dumpWriter = stream.NALTypeWriter(dumpWriter, types...)
+		}
+		writer = io.MultiWriter(dumpWriter, wsh)
+	}
+	streamer := stream.NewStreamer(options, writer)
+	streamer.AddDropCounter(wsh)
+	streamer.SetAlwaysOn(*alwaysOn)
+	go streamer.Run(connectionNumber)
+	router.HandleFunc(statsURL, streamer.StatsHandler)
+	router.HandleFunc(infoURL, streamer.InfoHandler)
+	router.HandleFunc(snapshotURL, streamer.SnapshotHandler)
 
 	// Static
-	fs := http.FileServer(http.Dir(staticDir))
-	router.PathPrefix(staticURL).Handler(handlers.CompressHandler(http.StripPrefix(staticURL, fs)))
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(port), router))
+	router.PathPrefix(staticURL).Handler(static.NewHandler(static.Options{Prefix: staticURL, Compress: true}))
+	server := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: router, TLSConfig: tlsConfig}
+	go func() {
+		// Let the clients receive the frames already queued for them before exiting
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := wsh.Shutdown(ctx); err != nil {
+			slog.Warn("main: Connections not closed in time", slog.Any("error", err))
+		}
+		server.Shutdown(ctx)
+	}()
+	var err error
+	if *tlsCert != "" {
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// openDump opens the file receiving a copy of the stream
+func openDump(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
+
+// parseNALTypes parses a comma-separated list of NAL unit types
+func parseNALTypes(list string) ([]uint8, error) {
+	var types []uint8
+	for _, field := range strings.Split(list, ",") {
+		nalType, err := strconv.ParseUint(strings.TrimSpace(field), 10, 5)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NAL unit type %q: %w", field, err)
+		}
+		types = append(types, uint8(nalType))
+	}
+	return types, nil
+}
+
+// stoppingWriter stops writing after the first error, e.g. when the disk is full,
+// without failing the writes: the other sinks of a tee keep receiving the stream
+type stoppingWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (w *stoppingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+	if _, err := w.writer.Write(p); err != nil {
+		w.err = err
+		if errors.Is(err, syscall.ENOSPC) {
+			slog.Error("dump: Disk full; dump stopped, streaming continues")
+		} else {
+			slog.Error("dump: Error writing; dump stopped, streaming continues", slog.Any("error", err))
+		}
+	}
+	return len(p), nil
 }
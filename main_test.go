@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/bezineb5/go-h264-streamer/stream"
+)
+
+// failingWriter accepts limit writes, then fails with err
+type failingWriter struct {
+	limit  int
+	err    error
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > w.limit {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+func TestStoppingWriter(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		log  string
+	}{
+		{"disk full", &os.PathError{Op: "write", Path: "dump.h264", Err: syscall.ENOSPC}, "dump: Disk full"},
+		{"other error", errors.New("I/O error"), "dump: Error writing"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			previous := slog.Default()
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+			defer slog.SetDefault(previous)
+
+			dump := &failingWriter{limit: 2, err: tt.err}
+			var live bytes.Buffer
+			tee := io.MultiWriter(&stoppingWriter{writer: dump}, &live)
+
+			nal := testNAL(stream.NALTypeIDR, 1, 2, 3)
+			const writes = 5
+			for i := 0; i < writes; i++ {
+				if n, err := tee.Write(nal); n != len(nal) || err != nil {
+					t.Fatalf("write %d = %d, %v; want %d, nil", i+1, n, err, len(nal))
+				}
+			}
+			// The stream goes on without the dump
+			if live.Len() != writes*len(nal) {
+				t.Errorf("other sink received %d bytes, want %d", live.Len(), writes*len(nal))
+			}
+			// Not written to again after the error
+			if dump.writes != dump.limit+1 {
+				t.Errorf("dump written %d times, want %d", dump.writes, dump.limit+1)
+			}
+			if n := strings.Count(logs.String(), tt.log); n != 1 {
+				t.Errorf("%q logged %d times, want once:\n%s", tt.log, n, logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/bezineb5/go-h264-streamer/stream"
+)
+
+const (
+	defaultShedInterval = 2 * time.Second
+	defaultShedHigh     = 0.8
+	defaultShedLow      = 0.2
+)
+
+// LoadShedding configures the reduction of the load when the broadcast can't keep up with the camera,
+// e.g. on a saturated CPU. The backpressure is measured over each interval as the larger of the average
+// filling of the broadcast queue and the share of frames dropped because it was full, between 0 and 1.
+type LoadShedding struct {
+	Interval time.Duration // Measurement interval. Defaults to 2 seconds.
+	High     float64       // Backpressure over a whole interval from which the load is shed. Defaults to 0.8.
+	Low      float64       // Backpressure over a whole interval below which shedding stops. Defaults to 0.2.
+
+	// KeyframesOnly delivers only the parameter sets and keyframes while shedding.
+	// The connections resume with the first keyframe after it stops.
+	KeyframesOnly bool
+
+	// OnChange, if set, is called in its own goroutine when shedding starts or stops,
+	// e.g. to switch the camera to a profile with a lower frame rate or bitrate
+	OnChange func(shedding bool)
+}
+
+// loadShedder measures the backpressure of the broadcast queue and decides when to shed the load
+type loadShedder struct {
+	options  LoadShedding
+	ticker   stream.Ticker
+	shedding bool
+
+	fill        float64 // Sum of the queue filling observed at each message of the interval
+	messages    int
+	lastDropped uint64 // Queue overflows at the start of the interval
+}
+
+func newLoadShedder(options LoadShedding, clock stream.Clock) *loadShedder {
+	if options.Interval <= 0 {
+		options.Interval = defaultShedInterval
+	}
+	if options.High <= 0 {
+		options.High = defaultShedHigh
+	}
+	if options.Low <= 0 {
+		options.Low = defaultShedLow
+	}
+	return &loadShedder{options: options, ticker: clock.NewTicker(options.Interval)}
+}
+
+// observe records the filling of the queue when a message is taken from it
+func (s *loadShedder) observe(queued, capacity int) {
+	s.fill += float64(queued) / float64(capacity)
+	s.messages++
+}
+
+// update computes the backpressure of the interval from the total number of queue overflows,
+// and starts or stops shedding accordingly
+func (s *loadShedder) update(overflows uint64) {
+	dropped := overflows - s.lastDropped
+	var pressure float64
+	if s.messages > 0 {
+		pressure = s.fill / float64(s.messages)
+	}
+	if total := float64(s.messages) + float64(dropped); total > 0 {
+		pressure = max(pressure, float64(dropped)/total)
+	}
+	s.fill, s.messages, s.lastDropped = 0, 0, overflows
+
+	switch {
+	case !s.shedding && pressure >= s.options.High:
+		s.shedding = true
+		slog.Warn("loadShedder: Broadcast overloaded; shedding load", slog.Float64("pressure", pressure))
+	case s.shedding && pressure <= s.options.Low:
+		s.shedding = false
+		slog.Info("loadShedder: Broadcast load eased; stopped shedding", slog.Float64("pressure", pressure))
+	default:
+		return
+	}
+	if s.options.OnChange != nil {
+		go s.options.OnChange(s.shedding)
+	}
+}
+
+// drops returns true if a message whose slices are of type nalType must be shed
+func (s *loadShedder) drops(nalType uint8) bool {
+	return s.shedding && s.options.KeyframesOnly && isSlice(nalType)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/bezineb5/go-h264-streamer/stream"
+)
+
+const (
+	sseDataPrefix = "data: "
+	sseEventEnd   = "\n\n"
+)
+
+// SSEHandler streams the video as Server-Sent Events, for networks where proxies block websockets.
+// It is a subscriber of the same hub as the websocket connections: it gets the same priming, keyframe wait,
+// bandwidth caps and lag eviction. The metadata is sent as a "metadata" event, and each binary message,
+// framed as negotiated by FrameHeader, as a default event whose data is the message encoded in base64.
+// Base64 and the event framing make the stream about 35% bigger than over a websocket, and the client
+// spends CPU decoding it.
+func (wsh *webSocketHandler) SSEHandler(w http.ResponseWriter, r *http.Request) {
+	if !wsh.authorize(w, r) {
+		return
+	}
+	if !wsh.track() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer wsh.untrack()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Don't let nginx buffer the events
+	w.WriteHeader(http.StatusOK)
+
+	c := &connection{send: make(chan []byte, 10), waitingKeyframe: true}
+	c.version = wsh.protocolVersion("")
+
+	if current := wsh.metadata.Load(); current != nil {
+		metadata := *current
+		metadata.Version = c.version
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			slog.Error("sse: Error encoding metadata", slog.Any("error", err))
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: metadata\ndata: %s\n\n", data); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	slog.Debug("sse: Got connection")
+	wsh.register <- c
+	wsh.options.OnEvent.Emit(wsh.clock, stream.Event{Type: stream.EventClientConnected, Client: r.RemoteAddr})
+	defer func() {
+		wsh.unregister <- c
+		wsh.options.OnEvent.Emit(wsh.clock, stream.Event{Type: stream.EventClientDisconnected, Client: r.RemoteAddr})
+	}()
+
+	var encoded []byte
+	write := func(msg []byte) error {
+		size := len(sseDataPrefix) + base64.StdEncoding.EncodedLen(len(msg)) + len(sseEventEnd)
+		if cap(encoded) < size {
+			encoded = make([]byte, size)
+		}
+		encoded = encoded[:size]
+		copy(encoded, sseDataPrefix)
+		base64.StdEncoding.Encode(encoded[len(sseDataPrefix):], msg)
+		copy(encoded[size-len(sseEventEnd):], sseEventEnd)
+		if _, err := w.Write(encoded); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-c.send:
+			if !ok {
+				// Removed by the hub
+				return
+			}
+			if err := write(msg); err != nil {
+				slog.Error("sse: Error writing event", slog.Any("error", err))
+				return
+			}
+		case <-wsh.closing:
+			if deadline, ok := wsh.drainDeadline(); ok {
+				http.NewResponseController(w).SetWriteDeadline(deadline)
+				c.drain(write)
+			}
+			return
+		}
+	}
+}
@@ -4448,15 +4448,55 @@ var WSAvcPlayer = new Class({
 
 
     var running = true;
+    this.playFrames(framesList, () => running);
 
+
+
+    this.ws.onclose = () => {
+      running = false;
+      log("WSAvcPlayer: Connection closed")
+    };
+
+  },
+
+  // Server-Sent Events fallback, for networks blocking websockets: frames are base64 encoded
+  connectSSE : function(url) {
+    if (this.es != undefined) {
+      this.es.close();
+      delete this.es;
+    }
+    this.es = new EventSource(url);
+
+    this.es.onopen = () => {
+      log("Connected to " + url);
+    };
+
+    var framesList = [];
+
+    this.es.addEventListener("metadata", (evt) => this.cmd(JSON.parse(evt.data)));
+    this.es.onmessage = (evt) => {
+      this.pktnum++;
+      var binary = atob(evt.data);
+      var frame = new Uint8Array(binary.length);
+      for (var i = 0; i < binary.length; i++)
+        frame[i] = binary.charCodeAt(i);
+      framesList.push(frame);
+    };
+
+    var es = this.es;
+    this.playFrames(framesList, () => es.readyState != EventSource.CLOSED);
+  },
+
+  // Decodes the queued frames at the display rate while isRunning returns true
+  playFrames : function(framesList, isRunning) {
     var shiftFrame = function() {
-      if(!running)
+      if(!isRunning())
         return;
 
 
       if(framesList.length > 10) {
         log("Dropping frames", framesList.length);
-        framesList = [];
+        framesList.length = 0;
       }
 
       var frame = framesList.shift();
@@ -4470,14 +4510,6 @@ var WSAvcPlayer = new Class({
 
 
     shiftFrame();
-
-
-
-    this.ws.onclose = () => {
-      running = false;
-      log("WSAvcPlayer: Connection closed")
-    };
-
   },
 
   initCanvas : function(width, height) {
@@ -4501,7 +4533,10 @@ var WSAvcPlayer = new Class({
   },
 
   disconnect : function() {
-    this.ws.close();
+    if (this.ws != undefined)
+      this.ws.close();
+    if (this.es != undefined)
+      this.es.close();
   },
 
   playStream : function() {
@@ -0,0 +1,42 @@
+// Package static embeds the web client playing the stream in a browser.
+// It is based on the Broadway H264 decoder of h264-live-player.
+package static
+
+import (
+	"embed"
+	"net/http"
+
+	"github.com/gorilla/handlers"
+)
+
+// FS contains the player page and its script
+//
+//go:embed index.html http-live-player.js
+var FS embed.FS
+
+// Options configures the serving of the web client
+type Options struct {
+	Dir      string // Directory to serve. If empty, the embedded player is served.
+	Prefix   string // URL prefix under which the handler is mounted, stripped from request paths
+	Compress bool   // Compress the responses if the client accepts it
+}
+
+// Handler serves the embedded player
+func Handler() http.Handler {
+	return http.FileServer(http.FS(FS))
+}
+
+// NewHandler serves the web client according to the options
+func NewHandler(options Options) http.Handler {
+	handler := Handler()
+	if options.Dir != "" {
+		handler = http.FileServer(http.Dir(options.Dir))
+	}
+	if options.Prefix != "" {
+		handler = http.StripPrefix(options.Prefix, handler)
+	}
+	if options.Compress {
+		handler = handlers.CompressHandler(handler)
+	}
+	return handler
+}
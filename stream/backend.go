@@ -0,0 +1,122 @@
+package stream
+
+import (
+	"fmt"
+	"os/exec"
+	"reflect"
+	"slices"
+)
+
+// Backend is the command line tool used to capture the video
+type Backend string
+
+// Supported backends
+const (
+	BackendRaspivid  Backend = "raspivid"      // Legacy camera stack
+	BackendLibcamera Backend = "libcamera-vid" // libcamera stack
+	BackendRpicam    Backend = "rpicam-vid"    // libcamera stack, tools renamed since Raspberry Pi OS Bookworm
+)
+
+// libcameraBackends are the backends based on the libcamera stack, newest first
+var libcameraBackends = []Backend{BackendRpicam, BackendLibcamera}
+
+// isLibcamera returns true if the backend is based on the libcamera stack
+func (backend Backend) isLibcamera() bool {
+	return slices.Contains(libcameraBackends, backend)
+}
+
+// valid returns true if the backend is known
+func (backend Backend) valid() bool {
+	return backend == BackendRaspivid || backend.isLibcamera()
+}
+
+// stillCommand returns the command capturing still images with the same camera stack
+func (backend Backend) stillCommand() string {
+	switch backend {
+	case BackendLibcamera:
+		return "libcamera-still"
+	case BackendRpicam:
+		return "rpicam-still"
+	default:
+		return "raspistill"
+	}
+}
+
+// backendOptions lists the CameraOptions fields honored only by some backends, and how to know if they are set.
+// Fields not listed are supported by all backends.
+var backendOptions = map[string]struct {
+	backends []Backend
+	isSet    func(options CameraOptions) bool
+}{
+	"TuningFile": {
+		backends: libcameraBackends,
+		isSet:    func(options CameraOptions) bool { return options.TuningFile != "" },
+	},
+	"Codec": {
+		backends: libcameraBackends,
+		isSet:    func(options CameraOptions) bool { return options.Codec == CodecLibav },
+	},
+	"LibavCodecOptions": {
+		backends: libcameraBackends,
+		isSet:    func(options CameraOptions) bool { return options.LibavCodecOptions != "" },
+	},
+	"LowLatency": {
+		backends: libcameraBackends,
+		isSet:    func(options CameraOptions) bool { return options.LowLatency },
+	},
+}
+
+// SupportedOptions returns the names of the CameraOptions fields honored by the backend
+func SupportedOptions(backend Backend) []string {
+	var names []string
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(CameraOptions{})) {
+		if backend.supports(field.Name) {
+			names = append(names, field.Name)
+		}
+	}
+	return names
+}
+
+// supports returns true if the backend honors the CameraOptions field
+func (backend Backend) supports(name string) bool {
+	option, ok := backendOptions[name]
+	return !ok || slices.Contains(option.backends, backend)
+}
+
+// ignoredOptions returns the names of the fields which are set but not honored by the backend
+func (options CameraOptions) ignoredOptions(backend Backend) []string {
+	var names []string
+	for name, option := range backendOptions {
+		if option.isSet(options) && !backend.supports(name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// determineBackend returns the backend selected by the options.
+// It returns an error if the forced backend isn't installed.
+func determineBackend(options CameraOptions) (Backend, error) {
+	if options.ForceBackend != "" {
+		if _, err := exec.LookPath(string(options.ForceBackend)); err != nil {
+			return "", fmt.Errorf("forced backend %s: %w", options.ForceBackend, err)
+		}
+		return options.ForceBackend, nil
+	}
+
+	if options.AutoDetectLibCamera {
+		for _, backend := range libcameraBackends {
+			if _, err := exec.LookPath(string(backend)); err == nil {
+				return backend, nil
+			}
+		}
+		return BackendRaspivid, nil
+	}
+
+	if options.UseLibcamera {
+		return BackendLibcamera, nil
+	} else {
+		return BackendRaspivid, nil
+	}
+}
@@ -0,0 +1,51 @@
+package stream
+
+const (
+	minNALBufferSize = bufferSizeKB * 1024
+	maxNALBufferSize = 16 * 1024 * 1024
+	defaultBufferFps = 30
+
+	// idrFrameRatio is how many times bigger than the average frame an IDR frame can get: the other frames of the GOP
+	// only code the differences, so most of the bitrate goes to the keyframes when the scene is static
+	idrFrameRatio = 8
+	// rawFrameRatio is the minimum compression of an IDR frame relative to the YUV 4:2:0 picture at the default bitrates
+	rawFrameRatio = 4
+	// nalBufferHeadroom covers the bitrate spikes of the encoder rate control and the scenes which are hard to code
+	nalBufferHeadroom = 2
+)
+
+// RecommendedNALBufferSize returns the size of the buffer holding a NAL unit while it is read from the camera, large enough
+// for the biggest IDR slice expected from the resolution, bitrate and intra period of the options; bigger units are dropped.
+// It is used when CameraOptions.NALBufferSize is 0. It ranges from 256 KB, the historical fixed size, to 16 MB.
+func RecommendedNALBufferSize(options CameraOptions) int {
+	raw := 0
+	if options.Width > 0 && options.Height > 0 {
+		raw = options.Width * options.Height * 3 / 2
+	}
+	size := raw / rawFrameRatio
+	if options.Bitrate > 0 {
+		fps := options.Fps
+		if fps <= 0 {
+			fps = defaultBufferFps
+		}
+		ratio := idrFrameRatio
+		if options.IntraPeriod > 0 {
+			// The keyframe can't take more than the whole GOP
+			ratio = min(ratio, options.IntraPeriod)
+		}
+		size = options.Bitrate / 8 / fps * ratio
+		if raw > 0 {
+			// Even at a very high bitrate, an IDR frame doesn't get bigger than the uncompressed picture
+			size = min(size, raw)
+		}
+	}
+	return min(max(size*nalBufferHeadroom, minNALBufferSize), maxNALBufferSize)
+}
+
+// nalBufferSize returns the NAL buffer size of the options, or the recommended one if it isn't set
+func (options CameraOptions) nalBufferSize() int {
+	if options.NALBufferSize > 0 {
+		return options.NALBufferSize
+	}
+	return RecommendedNALBufferSize(options)
+}
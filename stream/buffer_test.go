@@ -0,0 +1,46 @@
+package stream
+
+import "testing"
+
+func TestRecommendedNALBufferSize(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		options CameraOptions
+		want    int
+	}{
+		{"no options", CameraOptions{}, minNALBufferSize},
+		{"small picture", CameraOptions{Width: 320, Height: 240}, minNALBufferSize},
+		// 1920x1080x1.5 / 4 x 2
+		{"1080p without bitrate", CameraOptions{Width: 1920, Height: 1080}, 1555200},
+		// 50 Mb/s / 8 / 30 fps x 8 x 2
+		{"4K at high bitrate", CameraOptions{Width: 3840, Height: 2160, Fps: 30, Bitrate: 50_000_000}, 3333328},
+		// 1 Gb/s would exceed the uncompressed picture, 3840x2160x1.5, x 2: clamped to the maximum
+		{"4K above the uncompressed size", CameraOptions{Width: 3840, Height: 2160, Fps: 30, Bitrate: 1_000_000_000}, maxNALBufferSize},
+		// 720p at 1 Gb/s: bounded by the uncompressed picture, 1280x720x1.5 x 2
+		{"720p above the uncompressed size", CameraOptions{Width: 1280, Height: 720, Fps: 30, Bitrate: 1_000_000_000}, 2764800},
+		{"bitrate without resolution", CameraOptions{Bitrate: 2_000_000_000}, maxNALBufferSize},
+		{"low bitrate", CameraOptions{Width: 1920, Height: 1080, Fps: 30, Bitrate: 1_000_000}, minNALBufferSize},
+		// 25 Mb/s / 8 / 30 fps, with the default frame rate
+		{"default frame rate", CameraOptions{Width: 1920, Height: 1080, Bitrate: 25_000_000}, 104166 * 8 * 2},
+		// The keyframe can't take more than the 2 frames of the GOP
+		{"short intra period", CameraOptions{Width: 1920, Height: 1080, Fps: 30, Bitrate: 25_000_000, IntraPeriod: 2}, 104166 * 2 * 2},
+		{"long intra period", CameraOptions{Width: 1920, Height: 1080, Fps: 30, Bitrate: 25_000_000, IntraPeriod: 60}, 104166 * 8 * 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RecommendedNALBufferSize(tt.options); got != tt.want {
+				t.Errorf("RecommendedNALBufferSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNALBufferSizeOverride(t *testing.T) {
+	options := CameraOptions{Width: 3840, Height: 2160, Bitrate: 50_000_000, NALBufferSize: 1024}
+	if got := options.nalBufferSize(); got != 1024 {
+		t.Errorf("nalBufferSize() = %d, want the configured 1024", got)
+	}
+	options.NALBufferSize = 0
+	if got, want := options.nalBufferSize(), RecommendedNALBufferSize(options); got != want {
+		t.Errorf("nalBufferSize() = %d, want the recommended %d", got, want)
+	}
+}
@@ -0,0 +1,127 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listCamerasTimeout bounds the enumeration of the cameras
+const listCamerasTimeout = 5 * time.Second
+
+var (
+	// ErrEnumerationUnsupported is returned by ListCameras for backends which can't list the cameras
+	ErrEnumerationUnsupported = errors.New("camera enumeration not supported by the backend")
+	// ErrUnsupportedResolution is returned when the requested size exceeds the resolution of the sensor
+	ErrUnsupportedResolution = errors.New("resolution not supported by the camera")
+)
+
+// CameraInfo describes a camera and its sensor modes, as reported by the libcamera tools
+type CameraInfo struct {
+	Index  int          `json:"index"`
+	Sensor string       `json:"sensor"` // Model of the sensor, e.g. imx219
+	Width  int          `json:"width"`  // Full resolution of the sensor
+	Height int          `json:"height"`
+	Modes  []SensorMode `json:"modes"`
+}
+
+// SensorMode is a native resolution of a sensor. Other sizes are scaled from one of them.
+type SensorMode struct {
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Fps    float64 `json:"fps"` // Maximum frame rate
+}
+
+func (mode SensorMode) String() string {
+	return fmt.Sprintf("%dx%d@%g", mode.Width, mode.Height, mode.Fps)
+}
+
+var (
+	// 0 : imx219 [3280x2464 10-bit RGGB] (/base/soc/i2c0mux/i2c@1/imx219@10)
+	cameraLineRegexp = regexp.MustCompile(`^\s*(\d+)\s*:\s*(\S+)\s*\[(\d+)x(\d+)`)
+	// 'SRGGB10_CSI2P' : 640x480 [206.65 fps - (1000, 752)/1280x960 crop]
+	modeRegexp = regexp.MustCompile(`(\d+)x(\d+) \[([\d.]+) fps`)
+)
+
+// ListCameras returns the cameras available to a libcamera backend, with their sensor modes.
+// It returns ErrEnumerationUnsupported for raspivid.
+func ListCameras(ctx context.Context, backend Backend) ([]CameraInfo, error) {
+	if !backend.isLibcamera() {
+		return nil, ErrEnumerationUnsupported
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, listCamerasTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, string(backend), "--list-cameras").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing cameras: %w", err)
+	}
+	return parseCameraList(string(output)), nil
+}
+
+// parseCameraList parses the output of --list-cameras. The modes of each size are merged across pixel formats.
+func parseCameraList(output string) []CameraInfo {
+	var cameras []CameraInfo
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := cameraLineRegexp.FindStringSubmatch(line); match != nil {
+			index, _ := strconv.Atoi(match[1])
+			width, _ := strconv.Atoi(match[3])
+			height, _ := strconv.Atoi(match[4])
+			cameras = append(cameras, CameraInfo{Index: index, Sensor: match[2], Width: width, Height: height})
+			continue
+		}
+		match := modeRegexp.FindStringSubmatch(line)
+		if match == nil || len(cameras) == 0 {
+			continue
+		}
+		camera := &cameras[len(cameras)-1]
+		width, _ := strconv.Atoi(match[1])
+		height, _ := strconv.Atoi(match[2])
+		fps, _ := strconv.ParseFloat(match[3], 64)
+		camera.addMode(SensorMode{Width: width, Height: height, Fps: fps})
+	}
+	return cameras
+}
+
+func (camera *CameraInfo) addMode(mode SensorMode) {
+	for i, known := range camera.Modes {
+		if known.Width == mode.Width && known.Height == mode.Height {
+			camera.Modes[i].Fps = max(known.Fps, mode.Fps)
+			return
+		}
+	}
+	camera.Modes = append(camera.Modes, mode)
+}
+
+// checkResolution checks that the first camera of a libcamera backend can provide the requested size,
+// before starting it. The check is skipped if the cameras can't be listed.
+func checkResolution(ctx context.Context, options CameraOptions, backend Backend) error {
+	if options.Width == 0 || options.Height == 0 || !backend.isLibcamera() {
+		return nil
+	}
+	cameras, err := ListCameras(ctx, backend)
+	if err != nil || len(cameras) == 0 {
+		slog.Debug("checkResolution: Cameras can't be listed; skipping the check", slog.Any("error", err))
+		return nil
+	}
+
+	camera := cameras[0]
+	if options.Width <= camera.Width && options.Height <= camera.Height {
+		return nil
+	}
+	modes := make([]string, len(camera.Modes))
+	for i, mode := range camera.Modes {
+		modes[i] = mode.String()
+	}
+	return fmt.Errorf("%w: %dx%d exceeds the %dx%d sensor %s; its modes are %s",
+		ErrUnsupportedResolution, options.Width, options.Height, camera.Width, camera.Height, camera.Sensor, strings.Join(modes, ", "))
+}
@@ -0,0 +1,159 @@
+package stream
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock provides the time functions used by timeout-dependent logic,
+// so that tests can replace it with a deterministic implementation
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker used through a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the Clock based on the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// ManualClock is a Clock whose time only changes when Advance is called, to test timeout-dependent logic
+// deterministically, without real sleeps. It is safe for concurrent use.
+type ManualClock struct {
+	mutex   sync.Mutex
+	changed *sync.Cond // Signaled when a timer is added
+	now     time.Time
+	timers  []*manualTimer
+}
+
+// manualTimer is a pending After channel, or a ticker if period is set
+type manualTimer struct {
+	deadline time.Time
+	period   time.Duration
+	c        chan time.Time
+	clock    *ManualClock
+}
+
+// NewManualClock creates a clock set to now
+func NewManualClock(now time.Time) *ManualClock {
+	c := &ManualClock{now: now}
+	c.changed = sync.NewCond(&c.mutex)
+	return c
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).c
+}
+
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("stream: non-positive interval for ManualClock.NewTicker")
+	}
+	return c.add(d, d)
+}
+
+func (c *ManualClock) add(d, period time.Duration) *manualTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := &manualTimer{deadline: c.now.Add(d), period: period, c: make(chan time.Time, 1), clock: c}
+	if d <= 0 && period == 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	c.changed.Broadcast()
+	return t
+}
+
+// Advance moves the time forward by d, firing the timers which expire in order.
+// Like time.Ticker, a ticker whose previous tick wasn't received drops the new ones.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	end := c.now.Add(d)
+	for {
+		next := -1
+		for i, t := range c.timers {
+			if !t.deadline.After(end) && (next < 0 || t.deadline.Before(c.timers[next].deadline)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		t := c.timers[next]
+		c.now = t.deadline
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		if t.period > 0 {
+			t.deadline = t.deadline.Add(t.period)
+		} else {
+			c.timers = slices.Delete(c.timers, next, next+1)
+		}
+	}
+	c.now = end
+}
+
+// WaitForTimers blocks until at least n timers or tickers are pending, e.g. until the goroutine under test
+// waits for a timeout, so that the test can then Advance the clock past it
+func (c *ManualClock) WaitForTimers(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.timers) < n {
+		c.changed.Wait()
+	}
+}
+
+func (t *manualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTimer) Stop() {
+	c := t.clock
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if i := slices.Index(c.timers, t); i >= 0 {
+		c.timers = slices.Delete(c.timers, i, i+1)
+	}
+}
@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+var testEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestManualClockAfter(t *testing.T) {
+	clock := NewManualClock(testEpoch)
+	c := clock.After(time.Second)
+
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-c:
+		t.Fatal("fired before its deadline")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case fired := <-c:
+		if want := testEpoch.Add(time.Second); !fired.Equal(want) {
+			t.Errorf("fired at %v, want %v", fired, want)
+		}
+	default:
+		t.Fatal("didn't fire at its deadline")
+	}
+	if now := clock.Now(); !now.Equal(testEpoch.Add(time.Second)) {
+		t.Errorf("Now() = %v", now)
+	}
+}
+
+func TestManualClockAfterNonPositive(t *testing.T) {
+	clock := NewManualClock(testEpoch)
+	select {
+	case <-clock.After(0):
+	default:
+		t.Fatal("After(0) didn't fire immediately")
+	}
+}
+
+func TestManualClockTicker(t *testing.T) {
+	clock := NewManualClock(testEpoch)
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(time.Second)
+	if fired := <-ticker.C(); !fired.Equal(testEpoch.Add(time.Second)) {
+		t.Errorf("first tick at %v", fired)
+	}
+
+	// Ticks which aren't received are dropped, like with time.Ticker
+	clock.Advance(3 * time.Second)
+	if fired := <-ticker.C(); !fired.Equal(testEpoch.Add(2 * time.Second)) {
+		t.Errorf("second tick at %v", fired)
+	}
+	select {
+	case <-ticker.C():
+		t.Fatal("more than one tick buffered")
+	default:
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Fatal("ticked after Stop")
+	default:
+	}
+}
+
+func TestManualClockWaitForTimers(t *testing.T) {
+	clock := NewManualClock(testEpoch)
+	done := make(chan struct{})
+	go func() {
+		<-clock.After(time.Minute)
+		close(done)
+	}()
+
+	clock.WaitForTimers(1)
+	clock.Advance(time.Minute)
+	<-done
+}
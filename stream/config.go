@@ -0,0 +1,81 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Duration is a time.Duration read from JSON either as a string parsed by time.ParseDuration, e.g. "500ms",
+// or as a number of nanoseconds. It is written as a number of nanoseconds.
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var nanoseconds int64
+		if err := json.Unmarshal(data, &nanoseconds); err != nil {
+			return fmt.Errorf("invalid duration %s: must be a string such as \"1s\" or a number of nanoseconds", data)
+		}
+		*d = Duration(nanoseconds)
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// LoadCameraOptions reads camera options from a JSON file and validates them
+func LoadCameraOptions(path string) (CameraOptions, error) {
+	var options CameraOptions
+
+	f, err := os.Open(path)
+	if err != nil {
+		return options, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&options); err != nil {
+		return options, fmt.Errorf("invalid camera options file %s: %w", path, err)
+	}
+
+	if err := options.Validate(); err != nil {
+		return options, fmt.Errorf("invalid camera options file %s: %w", path, err)
+	}
+	return options, nil
+}
+
+// LoadProfiles reads named camera options from a JSON file mapping profile names to options,
+// and validates them
+func LoadProfiles(path string) (Profiles, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var profiles Profiles
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&profiles); err != nil {
+		return nil, fmt.Errorf("invalid profiles file %s: %w", path, err)
+	}
+
+	for name, options := range profiles {
+		if err := options.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid profiles file %s: profile %s: %w", path, name, err)
+		}
+	}
+	return profiles, nil
+}
@@ -0,0 +1,116 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+const (
+	defaultDayNightInterval = time.Minute
+	brightnessWidth         = 64 // Width of the picture measured by Brightness: plenty for a mean
+)
+
+// DayNightDecider returns whether it is night, given the current state, e.g. from a schedule,
+// a light sensor or the Brightness of the stream
+type DayNightDecider func(ctx context.Context, night bool) (bool, error)
+
+// DayNightOptions configures the automatic switch between a day and a night profile
+type DayNightOptions struct {
+	Decide       DayNightDecider
+	Interval     time.Duration // Period of the decisions. Defaults to 1 minute.
+	DayProfile   string
+	NightProfile string // E.g. with the tuning file of a NoIR camera
+	// OnChange, if set, is called after switching profile, e.g. to toggle the IR-cut filter and IR LEDs through GPIO
+	OnChange func(night bool)
+}
+
+// RunDayNight switches between the day and night profiles registered with SetProfiles, as decided at every interval,
+// until ctx is cancelled. Decisions failing, e.g. with ErrNoKeyframe while the camera is stopped, are ignored.
+// A switch rejected with ErrReconfiguredRecently is retried at the next decision.
+func (s *Streamer) RunDayNight(ctx context.Context, options DayNightOptions) error {
+	if options.Decide == nil {
+		return errors.New("no day/night decision function")
+	}
+	names := s.ProfileNames()
+	for _, name := range []string{options.DayProfile, options.NightProfile} {
+		if !slices.Contains(names, name) {
+			return fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+		}
+	}
+	interval := options.Interval
+	if interval <= 0 {
+		interval = defaultDayNightInterval
+	}
+
+	night := s.Profile() == options.NightProfile
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+
+		decision, err := options.Decide(ctx, night)
+		if err != nil {
+			slog.Debug("RunDayNight: No decision", slog.Any("error", err))
+			continue
+		}
+		if decision == night {
+			continue
+		}
+
+		profile := options.DayProfile
+		if decision {
+			profile = options.NightProfile
+		}
+		if err := s.SwitchProfile(profile); err != nil {
+			slog.Warn("RunDayNight: Error switching profile", slog.String("profile", profile), slog.Any("error", err))
+			continue
+		}
+		night = decision
+		slog.Info("RunDayNight: Switched", slog.Bool("night", night))
+		if options.OnChange != nil {
+			options.OnChange(night)
+		}
+	}
+}
+
+// BrightnessDecider decides from the Brightness of the keyframe returned by keyframe, e.g. KeyframeCache.NALs.
+// It switches to night below nightBelow, and back to day above dayAbove. Set dayAbove higher than nightBelow,
+// accounting for the IR lighting of the night mode, so that the switch doesn't oscillate.
+func BrightnessDecider(keyframe func() [][]byte, nightBelow, dayAbove float64) DayNightDecider {
+	return func(ctx context.Context, night bool) (bool, error) {
+		brightness, err := Brightness(ctx, keyframe())
+		if err != nil {
+			return night, err
+		}
+		if night {
+			return brightness <= dayAbove, nil
+		}
+		return brightness < nightBelow, nil
+	}
+}
+
+// Brightness decodes a keyframe, given as SPS, PPS and IDR slices, with ffmpeg and returns its mean luma,
+// from 0 (black) to 255 (white)
+func Brightness(ctx context.Context, nals [][]byte) (float64, error) {
+	luma, err := decodeKeyframe(ctx, nals, "-vf", fmt.Sprintf("scale=%d:-2", brightnessWidth), "-f", "rawvideo", "-pix_fmt", "gray")
+	if err != nil {
+		return 0, err
+	}
+	if len(luma) == 0 {
+		return 0, errors.New("no picture decoded")
+	}
+	var sum uint64
+	for _, y := range luma {
+		sum += uint64(y)
+	}
+	return float64(sum) / float64(len(luma)), nil
+}
@@ -0,0 +1,59 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+const (
+	decoderCommand   = "ffmpeg"
+	decoderWaitDelay = time.Second
+)
+
+// ErrNoKeyframe is returned when no complete keyframe is available to decode
+var ErrNoKeyframe = errors.New("no keyframe available")
+
+// DecodeJPEG decodes a keyframe, given as SPS, PPS and IDR slices, to a JPEG image using ffmpeg
+func DecodeJPEG(ctx context.Context, nals [][]byte) ([]byte, error) {
+	return decodeKeyframe(ctx, nals, "-f", "image2pipe", "-c:v", "mjpeg")
+}
+
+// decodeKeyframe decodes the first picture of nals with ffmpeg, using the output format arguments
+func decodeKeyframe(ctx context.Context, nals [][]byte, outputArgs ...string) ([]byte, error) {
+	if !hasKeyframe(nals) {
+		return nil, ErrNoKeyframe
+	}
+
+	args := []string{"-loglevel", "error", "-f", "h264", "-i", "-", "-frames:v", "1"}
+	args = append(args, outputArgs...)
+	args = append(args, "-")
+
+	cmd := exec.CommandContext(ctx, decoderCommand, args...)
+	cmd.WaitDelay = decoderWaitDelay
+	var stdout bytes.Buffer
+	stderr := &tailBuffer{size: stderrTailSize}
+	cmd.Stdin = bytes.NewReader(bytes.Join(nals, nil))
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("decoding keyframe: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("decoding keyframe: %w: %s", err, stderr)
+	}
+	return stdout.Bytes(), nil
+}
+
+func hasKeyframe(nals [][]byte) bool {
+	for _, nal := range nals {
+		if NALType(nal) == NALTypeIDR {
+			return true
+		}
+	}
+	return false
+}
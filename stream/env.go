@@ -0,0 +1,97 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envVariables are the environment variables read by OptionsFromEnv, with the option they set
+var envVariables = []struct {
+	name string
+	set  func(options *CameraOptions, value string) error
+}{
+	{"CAMERA_WIDTH", intEnv(func(o *CameraOptions) *int { return &o.Width })},
+	{"CAMERA_HEIGHT", intEnv(func(o *CameraOptions) *int { return &o.Height })},
+	{"CAMERA_FPS", intEnv(func(o *CameraOptions) *int { return &o.Fps })},
+	{"CAMERA_HORIZONTAL_FLIP", boolEnv(func(o *CameraOptions) *bool { return &o.HorizontalFlip })},
+	{"CAMERA_VERTICAL_FLIP", boolEnv(func(o *CameraOptions) *bool { return &o.VerticalFlip })},
+	{"CAMERA_ROTATION", intEnv(func(o *CameraOptions) *int { return &o.Rotation })},
+	{"CAMERA_USE_LIBCAMERA", boolEnv(func(o *CameraOptions) *bool { return &o.UseLibcamera })},
+	{"CAMERA_AUTODETECT_LIBCAMERA", boolEnv(func(o *CameraOptions) *bool { return &o.AutoDetectLibCamera })},
+	{"CAMERA_BACKEND", func(o *CameraOptions, value string) error { o.ForceBackend = Backend(value); return nil }},
+	{"CAMERA_TUNING_FILE", func(o *CameraOptions, value string) error { o.TuningFile = value; return nil }},
+	{"CAMERA_INTRA_PERIOD", intEnv(func(o *CameraOptions) *int { return &o.IntraPeriod })},
+	{"CAMERA_BITRATE", intEnv(func(o *CameraOptions) *int { return &o.Bitrate })},
+	{"CAMERA_NAL_BUFFER_SIZE", intEnv(func(o *CameraOptions) *int { return &o.NALBufferSize })},
+	{"CAMERA_CODEC", func(o *CameraOptions, value string) error { o.Codec = Codec(value); return nil }},
+	{"CAMERA_LIBAV_CODEC_OPTIONS", func(o *CameraOptions, value string) error { o.LibavCodecOptions = value; return nil }},
+	{"CAMERA_LOW_LATENCY", boolEnv(func(o *CameraOptions) *bool { return &o.LowLatency })},
+	{"CAMERA_NICE", intEnv(func(o *CameraOptions) *int { return &o.Nice })},
+	{"CAMERA_IONICE", intEnv(func(o *CameraOptions) *int { return &o.IONice })},
+	{"CAMERA_IONICE_LEVEL", intEnv(func(o *CameraOptions) *int { return &o.IONiceLevel })},
+	{"CAMERA_START_RETRIES", intEnv(func(o *CameraOptions) *int { return &o.StartRetries })},
+	{"CAMERA_START_RETRY_DELAY", durationEnv(func(o *CameraOptions) *Duration { return &o.StartRetryDelay })},
+	{"CAMERA_READ_BUFFER_SIZE", intEnv(func(o *CameraOptions) *int { return &o.ReadBufferSize })},
+	{"CAMERA_QUEUE_SIZE", intEnv(func(o *CameraOptions) *int { return &o.QueueSize })},
+	{"CAMERA_FROZEN_TIMEOUT", durationEnv(func(o *CameraOptions) *Duration { return &o.FrozenTimeout })},
+}
+
+// OptionsFromEnv reads camera options from environment variables, for container deployments, and validates them.
+// The options of unset variables keep their zero value. The variables are:
+//
+//	CAMERA_WIDTH, CAMERA_HEIGHT, CAMERA_FPS, CAMERA_ROTATION, CAMERA_INTRA_PERIOD, CAMERA_BITRATE, CAMERA_NAL_BUFFER_SIZE, CAMERA_NICE,
+//	CAMERA_IONICE (1 realtime, 2 best effort, 3 idle), CAMERA_IONICE_LEVEL, CAMERA_START_RETRIES, CAMERA_READ_BUFFER_SIZE, CAMERA_QUEUE_SIZE: integers
+//	CAMERA_HORIZONTAL_FLIP, CAMERA_VERTICAL_FLIP, CAMERA_USE_LIBCAMERA, CAMERA_AUTODETECT_LIBCAMERA,
+//	CAMERA_LOW_LATENCY: booleans, e.g. true, false, 1, 0
+//	CAMERA_BACKEND, CAMERA_TUNING_FILE, CAMERA_CODEC, CAMERA_LIBAV_CODEC_OPTIONS: strings
+//	CAMERA_START_RETRY_DELAY, CAMERA_FROZEN_TIMEOUT: durations, e.g. 500ms, 10s
+//
+// Malformed values are all reported, joined with errors.Join.
+func OptionsFromEnv() (CameraOptions, error) {
+	var options CameraOptions
+	var errs []error
+	for _, variable := range envVariables {
+		value, ok := os.LookupEnv(variable.name)
+		if !ok {
+			continue
+		}
+		if err := variable.set(&options, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", variable.name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return options, fmt.Errorf("invalid camera options environment: %w", err)
+	}
+
+	if err := options.Validate(); err != nil {
+		return options, fmt.Errorf("invalid camera options environment: %w", err)
+	}
+	return options, nil
+}
+
+func intEnv(field func(o *CameraOptions) *int) func(o *CameraOptions, value string) error {
+	return func(o *CameraOptions, value string) error {
+		n, err := strconv.Atoi(value)
+		*field(o) = n
+		return err
+	}
+}
+
+func boolEnv(field func(o *CameraOptions) *bool) func(o *CameraOptions, value string) error {
+	return func(o *CameraOptions, value string) error {
+		b, err := strconv.ParseBool(value)
+		*field(o) = b
+		return err
+	}
+}
+
+func durationEnv(field func(o *CameraOptions) *Duration) func(o *CameraOptions, value string) error {
+	return func(o *CameraOptions, value string) error {
+		d, err := time.ParseDuration(value)
+		*field(o) = Duration(d)
+		return err
+	}
+}
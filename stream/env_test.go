@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv("CAMERA_WIDTH", "1280")
+	t.Setenv("CAMERA_VERTICAL_FLIP", "true")
+	t.Setenv("CAMERA_NICE", "-5")
+	t.Setenv("CAMERA_IONICE", "2")
+	t.Setenv("CAMERA_IONICE_LEVEL", "4")
+	t.Setenv("CAMERA_START_RETRY_DELAY", "500ms")
+
+	options, err := OptionsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Width != 1280 || !options.VerticalFlip || options.Nice != -5 {
+		t.Errorf("width %d, vertical flip %t, nice %d", options.Width, options.VerticalFlip, options.Nice)
+	}
+	if options.IONice != IONiceBestEffort || options.IONiceLevel != 4 {
+		t.Errorf("ionice class %d and level %d, want %d and 4", options.IONice, options.IONiceLevel, IONiceBestEffort)
+	}
+	if options.StartRetryDelay != Duration(500*time.Millisecond) {
+		t.Errorf("start retry delay %v", options.StartRetryDelay)
+	}
+}
+
+func TestOptionsFromEnvErrors(t *testing.T) {
+	t.Setenv("CAMERA_IONICE", "idle")
+	t.Setenv("CAMERA_VERTICAL_FLIP", "maybe")
+
+	_, err := OptionsFromEnv()
+	if err == nil {
+		t.Fatal("no error")
+	}
+	for _, name := range []string{"CAMERA_IONICE", "CAMERA_VERTICAL_FLIP"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q doesn't mention %s", err, name)
+		}
+	}
+
+	t.Setenv("CAMERA_IONICE", "3")
+	t.Setenv("CAMERA_IONICE_LEVEL", "4")
+	t.Setenv("CAMERA_VERTICAL_FLIP", "false")
+	if _, err := OptionsFromEnv(); err == nil {
+		t.Error("no error for a level of the idle class")
+	}
+}
@@ -0,0 +1,56 @@
+package stream
+
+import (
+	"io"
+	"time"
+)
+
+// EventType identifies a stream lifecycle event
+type EventType string
+
+// Lifecycle events
+const (
+	EventCameraStarted      EventType = "cameraStarted"      // The camera started producing its stream
+	EventCameraStopped      EventType = "cameraStopped"      // The camera was stopped or terminated
+	EventCameraError        EventType = "cameraError"        // The camera failed. Error is set.
+	EventKeyframeEmitted    EventType = "keyframeEmitted"    // The camera produced an IDR NAL unit
+	EventClientConnected    EventType = "clientConnected"    // A client connected. Client is set.
+	EventClientDisconnected EventType = "clientDisconnected" // A client disconnected. Client is set.
+)
+
+// Event is a stream lifecycle event
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Error  error  // Cause of an EventCameraError
+	Client string // Remote address of the client of EventClientConnected and EventClientDisconnected
+}
+
+// EventListener receives the lifecycle events. It is called synchronously, possibly from several goroutines:
+// it must be fast and safe for concurrent use, e.g. forward the event to a buffered channel.
+type EventListener func(event Event)
+
+// Emit sends an event to the listener, if any. The time of the event defaults to the current time of clock.
+func (listener EventListener) Emit(clock Clock, event Event) {
+	if listener == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = clock.Now()
+	}
+	listener(event)
+}
+
+// keyframeEventWriter emits EventKeyframeEmitted for the IDR NAL units written to it
+type keyframeEventWriter struct {
+	listener EventListener
+	writer   io.Writer
+	clock    Clock
+}
+
+func (w keyframeEventWriter) Write(nal []byte) (int, error) {
+	if NALType(nal) == NALTypeIDR {
+		w.listener.Emit(w.clock, Event{Type: EventKeyframeEmitted})
+	}
+	return w.writer.Write(nal)
+}
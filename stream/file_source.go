@@ -0,0 +1,137 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// maxPacingLag is how late a file source can be before it stops catching up
+const maxPacingLag = time.Second
+
+// FileSource returns a source playing an H264 Annex B file at fps frames per second, e.g. for demos and tests.
+// Playback starts at the first keyframe of the file. If loop is set, it restarts there at the end of the file,
+// so that the decoder never gets a picture referencing missing frames.
+func FileSource(path string, loop bool, fps int) Source {
+	return &fileSource{
+		path:  path,
+		loop:  loop,
+		fps:   fps,
+		clock: SystemClock,
+	}
+}
+
+type fileSource struct {
+	path  string
+	loop  bool
+	fps   int
+	clock Clock
+}
+
+func (s *fileSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	if s.fps <= 0 {
+		return nil, errors.New("file source: fps must be positive")
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	reader, writer := io.Pipe()
+	go func() {
+		defer f.Close()
+		writer.CloseWithError(s.play(ctx, f, writer))
+	}()
+
+	return &fileReader{PipeReader: reader, cancel: cancel}, nil
+}
+
+// play writes the NAL units of the file to w, paced at the frame rate
+func (s *fileSource) play(ctx context.Context, f io.ReadSeeker, w io.Writer) error {
+	pacer := &filePacer{
+		ctx:      ctx,
+		writer:   w,
+		clock:    s.clock,
+		interval: time.Second / time.Duration(s.fps),
+		next:     s.clock.Now(),
+	}
+
+	for {
+		pacer.started = false
+		pacer.frames = 0
+		splitter := newNALSplitter(H264Splitter, pacer, bufferSizeKB*1024)
+		if _, err := io.Copy(splitter, f); err != nil {
+			return err
+		}
+		if err := splitter.flush(); err != nil {
+			return err
+		}
+
+		if !s.loop {
+			return nil
+		}
+		if pacer.frames == 0 {
+			return errors.New("file source: no keyframe in file")
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+}
+
+// filePacer writes NAL units from the first keyframe on, one picture per interval
+type filePacer struct {
+	ctx      context.Context
+	writer   io.Writer
+	clock    Clock
+	interval time.Duration
+	next     time.Time
+	started  bool
+	frames   int
+}
+
+func (p *filePacer) Write(nal []byte) (int, error) {
+	nalType := NALType(nal)
+	if !p.started {
+		if nalType != NALTypeSPS && nalType != NALTypeIDR {
+			// Not decodable before the first keyframe
+			return len(nal), nil
+		}
+		p.started = true
+	}
+
+	// The slices following the first one belong to the same picture
+	if isVCL(nalType) && firstSliceOfPicture(nal) {
+		if wait := p.next.Sub(p.clock.Now()); wait > 0 {
+			select {
+			case <-p.ctx.Done():
+				return 0, p.ctx.Err()
+			case <-p.clock.After(wait):
+			}
+		} else if -wait > maxPacingLag {
+			p.next = p.clock.Now()
+		}
+		p.next = p.next.Add(p.interval)
+		p.frames++
+	}
+
+	if _, err := p.writer.Write(nal); err != nil {
+		return 0, err
+	}
+	return len(nal), nil
+}
+
+// fileReader reads the stream of a file source
+type fileReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+// Close stops the playback
+func (r *fileReader) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
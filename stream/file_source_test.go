@@ -0,0 +1,63 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncRecorder records the units written to it, for concurrent use
+type syncRecorder struct {
+	mutex sync.Mutex
+	units [][]byte
+}
+
+func (r *syncRecorder) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.units = append(r.units, bytes.Clone(p))
+	return len(p), nil
+}
+
+func (r *syncRecorder) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.units)
+}
+
+func TestFilePacerPacesPictures(t *testing.T) {
+	sps := []byte{0, 0, 0, 1, 0x67, 0x42}
+	// Pictures of two slices: first_mb_in_slice is 0 in the first one, not in the second one
+	idr := [][]byte{{0, 0, 0, 1, 0x65, 0x88}, {0, 0, 0, 1, 0x65, 0x40}}
+	slice := [][]byte{{0, 0, 0, 1, 0x41, 0x9a}, {0, 0, 0, 1, 0x41, 0x40}}
+	units := [][]byte{sps, idr[0], idr[1], slice[0], slice[1], slice[0], slice[1]}
+
+	clock := NewManualClock(testEpoch)
+	recorder := &syncRecorder{}
+	pacer := &filePacer{ctx: context.Background(), writer: recorder, clock: clock, interval: time.Second, next: clock.Now()}
+	done := make(chan struct{})
+	go func() {
+		for _, nal := range units {
+			pacer.Write(nal)
+		}
+		close(done)
+	}()
+
+	// Each picture is written at once, then the next one waits for the interval
+	for _, written := range []int{3, 5} {
+		clock.WaitForTimers(1)
+		if n := recorder.count(); n != written {
+			t.Fatalf("%d units written before waiting, want %d", n, written)
+		}
+		clock.Advance(time.Second)
+	}
+	<-done
+	if n := recorder.count(); n != len(units) {
+		t.Errorf("%d units written, want %d", n, len(units))
+	}
+	if pacer.frames != 3 {
+		t.Errorf("%d frames counted, want 3", pacer.frames)
+	}
+}
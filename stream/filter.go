@@ -0,0 +1,43 @@
+package stream
+
+import (
+	"io"
+	"slices"
+)
+
+// NALFilter transforms or drops a NAL unit before it is broadcast.
+// It returns the unit to broadcast, which can be nal itself, and false to drop it.
+//
+// The filter is called synchronously from the goroutine reading the camera, for every NAL unit:
+// it must be fast, or it delays the whole stream. Returning nal unchanged doesn't copy it.
+// The returned slice is owned by the broadcast path and must not be modified afterwards.
+type NALFilter func(nalType uint8, nal []byte) ([]byte, bool)
+
+// filterWriter applies a NALFilter to the NAL units written to it
+type filterWriter struct {
+	filter NALFilter
+	writer io.Writer
+}
+
+func (w filterWriter) Write(nal []byte) (int, error) {
+	out, ok := w.filter(NALType(nal), nal)
+	if !ok {
+		return len(nal), nil
+	}
+	if _, err := w.writer.Write(out); err != nil {
+		return 0, err
+	}
+	return len(nal), nil
+}
+
+// NALTypeWriter returns a writer passing only the NAL units of the given types to writer,
+// e.g. NALTypeSPS, NALTypePPS and NALTypeIDR to record keyframes only. Wrapping each sink of a tee
+// in its own NALTypeWriter gives each its own content.
+func NALTypeWriter(writer io.Writer, types ...uint8) io.Writer {
+	return filterWriter{
+		filter: func(nalType uint8, nal []byte) ([]byte, bool) {
+			return nal, slices.Contains(types, nalType)
+		},
+		writer: writer,
+	}
+}
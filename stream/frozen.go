@@ -0,0 +1,87 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// defaultFrozenSizeTolerance is the relative difference of size up to which the built-in comparison considers two keyframes
+// identical: re-encoding the same picture only changes a few bytes of the slice headers, while the sensor noise of a live
+// static scene changes the size of its keyframes by much more than 0.1%
+const defaultFrozenSizeTolerance = 0.001
+
+var errFrozenFrame = errors.New("camera output frozen")
+
+// KeyframeComparator returns true if two consecutive keyframes, given as their IDR slices, show the same picture
+type KeyframeComparator func(previous, current [][]byte) bool
+
+// sameKeyframeSize returns the built-in KeyframeComparator: identical pictures are encoded to keyframes of nearly the same size.
+// Keyframes whose sizes differ by at most tolerance times the size of the previous one are considered identical.
+func sameKeyframeSize(tolerance float64) KeyframeComparator {
+	return func(previous, current [][]byte) bool {
+		size := keyframeSize(previous)
+		diff := math.Abs(float64(size - keyframeSize(current)))
+		return diff <= tolerance*float64(size)
+	}
+}
+
+func keyframeSize(slices [][]byte) int {
+	size := 0
+	for _, slice := range slices {
+		size += len(slice)
+	}
+	return size
+}
+
+// frozenWatchdog detects a camera repeating the same picture while its stream keeps flowing,
+// by comparing its consecutive keyframes
+type frozenWatchdog struct {
+	writer  io.Writer
+	timeout time.Duration
+	same    KeyframeComparator
+	clock   Clock
+
+	previous    [][]byte  // Latest complete keyframe
+	current     [][]byte  // Slices of the keyframe being received
+	frozenSince time.Time // Time of the first keyframe identical to the previous ones, zero if the pictures change
+	frozen      bool
+}
+
+func newFrozenWatchdog(writer io.Writer, options CameraOptions, clock Clock) *frozenWatchdog {
+	same := options.SameKeyframes
+	if same == nil {
+		tolerance := options.FrozenSizeTolerance
+		if tolerance == 0 {
+			tolerance = defaultFrozenSizeTolerance
+		}
+		same = sameKeyframeSize(tolerance)
+	}
+	return &frozenWatchdog{writer: writer, timeout: time.Duration(options.FrozenTimeout), same: same, clock: clock}
+}
+
+func (w *frozenWatchdog) Write(nal []byte) (int, error) {
+	if NALType(nal) == NALTypeIDR {
+		w.current = append(w.current, nal)
+	} else if len(w.current) > 0 {
+		w.keyframe(w.current)
+		w.current = nil
+	}
+	return w.writer.Write(nal)
+}
+
+// keyframe compares a complete keyframe with the previous one
+func (w *frozenWatchdog) keyframe(slices [][]byte) {
+	now := w.clock.Now()
+	if w.previous == nil || !w.same(w.previous, slices) {
+		w.frozenSince = time.Time{}
+	} else if w.frozenSince.IsZero() {
+		w.frozenSince = now
+	} else if now.Sub(w.frozenSince) >= w.timeout && !w.frozen {
+		slog.Warn("frozenWatchdog: Camera repeats the same picture", slog.Duration("since", now.Sub(w.frozenSince)))
+		w.frozen = true
+	}
+	w.previous = slices
+}
@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// keyframeOfSize returns an IDR slice of the given size
+func keyframeOfSize(size int) []byte {
+	return append([]byte{0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0x88}, size-5)...)
+}
+
+func TestFrozenWatchdog(t *testing.T) {
+	slice := []byte{0, 0, 0, 1, 0x41, 0x9a}
+	for _, tt := range []struct {
+		name      string
+		tolerance float64
+		sizes     []int // Sizes of the consecutive keyframes, one per second, repeated
+		frozen    bool
+	}{
+		// Only the slice headers change
+		{"stuck sensor", 0, []int{50000, 50002, 49999, 50001}, true},
+		// The sensor noise changes the size by about 1%
+		{"static scene", 0, []int{50000, 50600, 49500, 50300}, false},
+		{"moving scene", 0, []int{50000, 62000, 41000, 57000}, false},
+		{"static scene with a high tolerance", 0.05, []int{50000, 50600, 49500, 50300}, true},
+		{"stuck sensor with a low tolerance", 0.00001, []int{50000, 50002, 49999, 50001}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewManualClock(testEpoch)
+			options := CameraOptions{FrozenTimeout: Duration(10 * time.Second), FrozenSizeTolerance: tt.tolerance}
+			w := newFrozenWatchdog(io.Discard, options, clock)
+			for i := 0; i < 30; i++ {
+				w.Write(keyframeOfSize(tt.sizes[i%len(tt.sizes)]))
+				w.Write(slice)
+				clock.Advance(time.Second)
+			}
+			if w.frozen != tt.frozen {
+				t.Errorf("frozen = %t after 30 s, want %t", w.frozen, tt.frozen)
+			}
+		})
+	}
+}
+
+func TestFrozenWatchdogIgnoresLoopingFile(t *testing.T) {
+	// A single GOP: the same keyframe repeats at every loop
+	path := filepath.Join(t.TempDir(), "loop.h264")
+	if err := os.WriteFile(path, testStream, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	options := CameraOptions{
+		Source:        FileSource(path, true, 200),
+		FrozenTimeout: Duration(20 * time.Millisecond),
+		RestartPolicy: RestartPolicy{InitialDelay: Duration(time.Millisecond)},
+	}
+	s := NewStreamer(options, io.Discard)
+	connections := runStreamer(t, s)
+	connections <- 1
+
+	// About 50 loops, over the frozen timeout many times
+	time.Sleep(500 * time.Millisecond)
+	if restarts := s.Stats().Restarts; restarts != 0 {
+		t.Errorf("camera restarted %d times while looping a file", restarts)
+	}
+}
@@ -0,0 +1,158 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+const maxOptionsRequestSize = 64 * 1024
+
+// optionsRequest holds the options which can be changed over HTTP, nil if missing from the request.
+// The others, e.g. the source or the commands run, can only be set by the application.
+type optionsRequest struct {
+	Width          *int  `json:"width"`
+	Height         *int  `json:"height"`
+	Fps            *int  `json:"fps"`
+	HorizontalFlip *bool `json:"horizontalFlip"`
+	VerticalFlip   *bool `json:"verticalFlip"`
+}
+
+// apply sets the options of the request
+func (request optionsRequest) apply(options *CameraOptions) {
+	set := func(field *int, value *int) {
+		if value != nil {
+			*field = *value
+		}
+	}
+	set(&options.Width, request.Width)
+	set(&options.Height, request.Height)
+	set(&options.Fps, request.Fps)
+	if request.HorizontalFlip != nil {
+		options.HorizontalFlip = *request.HorizontalFlip
+	}
+	if request.VerticalFlip != nil {
+		options.VerticalFlip = *request.VerticalFlip
+	}
+}
+
+// optionsResponse is the answer to a change of options
+type optionsResponse struct {
+	Restarted bool          `json:"restarted"` // True if the camera was restarted to apply the options
+	Options   CameraOptions `json:"options"`
+}
+
+// OptionsHandler returns the camera options as JSON on GET, and applies new options on POST or PUT.
+// Only the width, height, fps, horizontalFlip and verticalFlip fields can be posted; the others are rejected,
+// as they could run arbitrary commands. Fields missing from the posted JSON keep their current value.
+// It doesn't authenticate the requests: mount it behind an authorization middleware.
+func (s *Streamer) OptionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.Options())
+
+	case http.MethodPost, http.MethodPut:
+		var request optionsRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxOptionsRequestSize))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		options := s.Options()
+		request.apply(&options)
+
+		restarted, err := s.Reconfigure(options)
+		if errors.Is(err, ErrReconfiguredRecently) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("Streamer: Options changed", slog.Bool("restarted", restarted))
+		writeJSON(w, http.StatusOK, optionsResponse{Restarted: restarted, Options: options})
+
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// profileRequest selects a profile
+type profileRequest struct {
+	Profile string `json:"profile"`
+}
+
+// profileResponse describes the current and available profiles
+type profileResponse struct {
+	Profile  string   `json:"profile"`
+	Profiles []string `json:"profiles"`
+}
+
+// ProfileHandler returns the current and available profiles as JSON on GET,
+// and switches to the profile named in a {"profile": "name"} body on POST or PUT.
+// It doesn't authenticate the requests: mount it behind an authorization middleware.
+func (s *Streamer) ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, profileResponse{Profile: s.Profile(), Profiles: s.ProfileNames()})
+
+	case http.MethodPost, http.MethodPut:
+		var request profileRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxOptionsRequestSize))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := s.SwitchProfile(request.Profile)
+		if errors.Is(err, ErrUnknownProfile) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if errors.Is(err, ErrReconfiguredRecently) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, profileResponse{Profile: s.Profile(), Profiles: s.ProfileNames()})
+
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// SnapshotHandler returns a JPEG image of the latest keyframe of the stream, taken with SnapshotFromStream.
+// The status is 503 Service Unavailable if the camera isn't streaming,
+// and 429 Too Many Requests if too many snapshots are in progress.
+func (s *Streamer) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	image, err := s.SnapshotFromStream(r.Context())
+	if errors.Is(err, ErrNoKeyframe) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, ErrTooManySnapshots) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		slog.Error("Streamer: Error taking snapshot", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(image)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("writeJSON: Error writing response", slog.Any("error", err))
+	}
+}
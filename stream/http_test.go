@@ -0,0 +1,80 @@
+package stream
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOptionsHandler(t *testing.T) {
+	initial := CameraOptions{Width: 960, Height: 540, Fps: 30, PipelineCommand: []string{"camera-pipeline"}}
+
+	for _, tt := range []struct {
+		name       string
+		body       string
+		wantStatus int
+		want       CameraOptions
+	}{
+		{
+			name:       "resolution and flip",
+			body:       `{"width": 640, "height": 480, "verticalFlip": true}`,
+			wantStatus: http.StatusOK,
+			want:       CameraOptions{Width: 640, Height: 480, Fps: 30, VerticalFlip: true, PipelineCommand: []string{"camera-pipeline"}},
+		},
+		{
+			name:       "invalid value",
+			body:       `{"fps": -1}`,
+			wantStatus: http.StatusBadRequest,
+			want:       initial,
+		},
+		{
+			name:       "command",
+			body:       `{"pipelineCommand": ["sh", "-c", "reboot"]}`,
+			wantStatus: http.StatusBadRequest,
+			want:       initial,
+		},
+		{
+			name:       "command of a fallback",
+			body:       `{"fallbacks": [{"pipelineCommand": ["sh", "-c", "reboot"]}]}`,
+			wantStatus: http.StatusBadRequest,
+			want:       initial,
+		},
+		{
+			name:       "tuning file",
+			body:       `{"tuningFile": "/etc/shadow"}`,
+			wantStatus: http.StatusBadRequest,
+			want:       initial,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStreamer(initial, io.Discard)
+			recorder := httptest.NewRecorder()
+			s.OptionsHandler(recorder, httptest.NewRequest(http.MethodPost, "/options", strings.NewReader(tt.body)))
+
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", recorder.Code, tt.wantStatus, recorder.Body)
+			}
+			got := s.Options()
+			if got.Width != tt.want.Width || got.Height != tt.want.Height || got.Fps != tt.want.Fps ||
+				got.HorizontalFlip != tt.want.HorizontalFlip || got.VerticalFlip != tt.want.VerticalFlip ||
+				got.TuningFile != tt.want.TuningFile || len(got.Fallbacks) != 0 ||
+				!slices.Equal(got.PipelineCommand, tt.want.PipelineCommand) {
+				t.Errorf("options %+v, want %+v", got, tt.want)
+			}
+			if recorder.Code != http.StatusOK {
+				return
+			}
+			var response optionsResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Restarted {
+				t.Error("restart reported while the camera isn't running")
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package stream
+
+import "net/http"
+
+// Info describes the stream for dashboards and monitoring: its activity and health, as Stats, and its configuration
+type Info struct {
+	Stats
+	Params      Params  `json:"params"`      // Actual parameters of the stream, zero until the camera produced an SPS
+	Backend     string  `json:"backend"`     // Camera command selected by the options, "pipeline" for PipelineCommand, "source" for Source
+	Profile     string  `json:"profile"`     // Name of the profile of the current options, "" if set otherwise
+	Connections int     `json:"connections"` // Number of connections, as last notified to Run
+	Uptime      float64 `json:"uptime"`      // Seconds since the camera was last started, 0 if it isn't running
+}
+
+// Info returns the description of the stream
+func (s *Streamer) Info() Info {
+	info := Info{Stats: s.Stats()}
+	info.Params, _ = s.ActualParams()
+
+	s.mutex.Lock()
+	options := s.options
+	info.Profile = s.profile
+	info.Connections = s.connections
+	if s.state == cameraRunning {
+		info.Uptime = s.clock.Now().Sub(s.started).Seconds()
+	}
+	s.mutex.Unlock()
+
+	switch {
+	case options.Source != nil:
+		info.Backend = "source"
+	case len(options.PipelineCommand) > 0:
+		info.Backend = "pipeline"
+	default:
+		// Reported even if the forced backend isn't installed
+		backend, _ := determineBackend(options)
+		if backend == "" {
+			backend = options.ForceBackend
+		}
+		info.Backend = string(backend)
+	}
+	return info
+}
+
+// InfoHandler returns the description of the stream as JSON. Unlike StatsHandler, the status is always 200 OK:
+// the health is reported in the body.
+func (s *Streamer) InfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, s.Info())
+}
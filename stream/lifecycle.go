@@ -0,0 +1,89 @@
+package stream
+
+import (
+	"context"
+	"log/slog"
+)
+
+// cameraState is the lifecycle state of the camera of a Streamer.
+//
+// Every signal changing it (connections, shutdown, restart, reconfiguration, termination of the camera)
+// is applied with Streamer.mutex held, by a single transition, so overlapping signals are applied one after the other,
+// each to the state left by the previous one, instead of racing:
+//
+//	stopped --start-----> running  First connection, or SetAlwaysOn
+//	failed  --start-----> running  Connection or SetAlwaysOn after the camera gave up
+//	running --restart---> running  RestartCamera, Reconfigure or SwitchProfile: a new run replaces the current one
+//	running --stop------> stopped  No more connections and not always on, or shutdown
+//	failed  --stop------> stopped
+//	running --terminate-> stopped  The camera stream ended by itself
+//	running --fail------> failed   The camera failed and the restart policy gave up
+//
+// The other signals leave the state unchanged: start while running, stop while stopped,
+// restart while not running (RestartCamera returns ErrCameraNotRunning, Reconfigure only stores the options).
+// Each run of the camera has its own context, cancelled when it is stopped or replaced:
+// the termination of a run which was cancelled is ignored, so it can't stop the run which replaced it.
+type cameraState string
+
+const (
+	cameraStopped cameraState = "stopped"
+	cameraRunning cameraState = "running"
+	cameraFailed  cameraState = "failed" // The camera gave up while clients are connected
+)
+
+// startLocked starts a run of the camera, unless it is running
+func (s *Streamer) startLocked() {
+	if s.state == cameraRunning {
+		return
+	}
+	s.runLocked()
+}
+
+// restartLocked replaces the running camera by a new run, with the current options
+func (s *Streamer) restartLocked() error {
+	if s.state != cameraRunning {
+		return ErrCameraNotRunning
+	}
+	s.stopCamera()
+	s.runLocked()
+	return nil
+}
+
+// stopLocked stops the camera, if it is running
+func (s *Streamer) stopLocked() {
+	if s.state == cameraRunning {
+		s.stopCamera()
+	}
+	s.setState(cameraStopped)
+}
+
+// terminatedLocked applies the termination of the run of ctx, unless it was stopped or replaced in the meantime
+func (s *Streamer) terminatedLocked(ctx context.Context, failed bool) {
+	if ctx.Err() != nil {
+		return
+	}
+	s.stopCamera()
+	if failed {
+		s.setState(cameraFailed)
+	} else {
+		s.setState(cameraStopped)
+	}
+}
+
+func (s *Streamer) runLocked() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopCamera = cancel
+	s.started = s.clock.Now()
+	s.setState(cameraRunning)
+	go s.runCamera(ctx, s.options)
+}
+
+func (s *Streamer) setState(state cameraState) {
+	if state != cameraRunning {
+		s.stopCamera = nil
+	}
+	if state != s.state {
+		slog.Debug("Streamer: Camera state changed", slog.String("from", string(s.state)), slog.String("to", string(state)))
+		s.state = state
+	}
+}
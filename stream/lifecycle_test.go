@@ -0,0 +1,176 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// cameraStateOf returns the lifecycle state of the camera of a streamer
+func cameraStateOf(s *Streamer) cameraState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+// waitForOpens fails the test if the camera isn't opened the given number of times in time
+func waitForOpens(t *testing.T, source *fakeSource, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for source.opens.Load() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("camera opened %d times, want %d", source.opens.Load(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForState fails the test if the camera doesn't reach a state in time
+func waitForState(t *testing.T, s *Streamer, want cameraState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for cameraStateOf(s) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("camera %s, want %s", cameraStateOf(s), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLifecycleConnections(t *testing.T) {
+	source := &fakeSource{stream: testStream}
+	s := NewStreamer(CameraOptions{Source: source}, io.Discard)
+	connections := runStreamer(t, s)
+
+	// stopped --start--> running
+	connections <- 1
+	waitForState(t, s, cameraRunning)
+	waitForOpens(t, source, 1)
+	// Start while running: unchanged. Run applies a change before receiving the next one.
+	connections <- 2
+	connections <- 2
+	if state, opens := cameraStateOf(s), source.opens.Load(); state != cameraRunning || opens != 1 {
+		t.Errorf("camera %s, opened %d times after a second connection; want running, opened once", state, opens)
+	}
+
+	// running --stop--> stopped
+	connections <- 0
+	waitForState(t, s, cameraStopped)
+	// Stop while stopped: unchanged
+	connections <- 0
+	connections <- 0
+	if state := cameraStateOf(s); state != cameraStopped {
+		t.Errorf("camera %s after a second stop, want stopped", state)
+	}
+
+	// Always on: running without connections
+	s.SetAlwaysOn(true)
+	if state := cameraStateOf(s); state != cameraRunning {
+		t.Errorf("camera %s when always on, want running", state)
+	}
+	s.SetAlwaysOn(false)
+	if state := cameraStateOf(s); state != cameraStopped {
+		t.Errorf("camera %s when no longer always on, want stopped", state)
+	}
+}
+
+func TestLifecycleRestart(t *testing.T) {
+	source := &fakeSource{stream: testStream}
+	s := NewStreamer(CameraOptions{Source: source}, io.Discard)
+	connections := runStreamer(t, s)
+
+	// Restart while stopped: refused
+	if err := s.RestartCamera(); !errors.Is(err, ErrCameraNotRunning) {
+		t.Errorf("RestartCamera() while stopped = %v, want %v", err, ErrCameraNotRunning)
+	}
+
+	connections <- 1
+	waitForOpens(t, source, 1)
+	// running --restart--> running: a new run replaces the current one
+	if err := s.RestartCamera(); err != nil {
+		t.Fatalf("RestartCamera() = %v", err)
+	}
+	waitForOpens(t, source, 2)
+	// The end of the replaced run doesn't stop the new one
+	deadline := time.Now().Add(5 * time.Second)
+	for source.readers.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d camera outputs open after a restart, want 1", source.readers.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if state := cameraStateOf(s); state != cameraRunning {
+		t.Errorf("camera %s after a restart, want running", state)
+	}
+}
+
+func TestLifecycleTermination(t *testing.T) {
+	source := &fakeSource{stream: testStream, ends: true}
+	s := NewStreamer(CameraOptions{Source: source}, io.Discard)
+	connections := runStreamer(t, s)
+
+	// running --terminate--> stopped
+	connections <- 1
+	waitForOpens(t, source, 1)
+	waitForState(t, s, cameraStopped)
+	if opens := source.opens.Load(); opens != 1 {
+		t.Errorf("camera opened %d times, want once: a stream ending by itself isn't restarted", opens)
+	}
+}
+
+func TestLifecycleFailure(t *testing.T) {
+	source := &fakeSource{err: errors.New("no camera")}
+	clock := NewManualClock(testEpoch)
+	options := CameraOptions{Source: source, RestartPolicy: RestartPolicy{InitialDelay: Duration(time.Second), MaxAttempts: 1}}
+	s := NewStreamer(options, io.Discard)
+	s.SetClock(clock)
+	connections := make(chan int)
+	done := make(chan struct{})
+	go func() {
+		s.Run(connections)
+		close(done)
+	}()
+
+	// running --fail--> failed, once the restart policy gives up
+	connections <- 1
+	clock.WaitForTimers(1)
+	clock.Advance(time.Second)
+	waitForState(t, s, cameraFailed)
+	if opens := source.opens.Load(); opens != 2 {
+		t.Errorf("camera opened %d times, want 2", opens)
+	}
+
+	// failed --start--> running
+	connections <- 2
+	clock.WaitForTimers(1)
+	if state, opens := cameraStateOf(s), source.opens.Load(); state != cameraRunning || opens != 3 {
+		t.Errorf("camera %s, opened %d times after a new connection; want running, opened 3 times", state, opens)
+	}
+
+	// Shutdown: running --stop--> stopped
+	close(connections)
+	<-done
+	if state := cameraStateOf(s); state != cameraStopped {
+		t.Errorf("camera %s after shutdown, want stopped", state)
+	}
+}
+
+func TestEventTimeFromClock(t *testing.T) {
+	clock := NewManualClock(testEpoch)
+	clock.Advance(time.Minute)
+	events := make(chan Event, 2)
+	listener := EventListener(func(event Event) { events <- event })
+
+	w := keyframeEventWriter{listener: listener, writer: io.Discard, clock: clock}
+	w.Write([]byte{0, 0, 0, 1, 0x65, 0x88})
+	if event := <-events; event.Type != EventKeyframeEmitted || !event.Time.Equal(testEpoch.Add(time.Minute)) {
+		t.Errorf("got %s at %v, want %s at the clock time", event.Type, event.Time, EventKeyframeEmitted)
+	}
+
+	// A time set by the caller is kept
+	listener.Emit(clock, Event{Type: EventCameraStopped, Time: testEpoch})
+	if event := <-events; !event.Time.Equal(testEpoch) {
+		t.Errorf("event time %v, want %v", event.Time, testEpoch)
+	}
+}
@@ -0,0 +1,49 @@
+package stream
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// RepeatedLogInterval is the minimum interval between two lines of a LogLimiter
+const RepeatedLogInterval = time.Minute
+
+// LogLimiter throttles a log message repeated at high frequency, e.g. during a fault storm,
+// to keep the logs readable and spare the SD card. The first occurrence is logged; the next ones are counted,
+// and logged at most once per interval with the number of occurrences since the previous line. It is safe for concurrent use.
+type LogLimiter struct {
+	interval time.Duration
+	clock    Clock
+
+	mutex    sync.Mutex
+	last     time.Time // Time of the last line, zero before the first one
+	repeated int       // Occurrences since the last line, not logged
+}
+
+// NewLogLimiter creates a limiter logging at most once per interval
+func NewLogLimiter(interval time.Duration) *LogLimiter {
+	return &LogLimiter{interval: interval, clock: SystemClock}
+}
+
+// Log logs the message with the default logger, unless it was logged less than the interval ago.
+// The line carries the number of occurrences which weren't logged since the previous line, as "repeated", if there were any.
+func (l *LogLimiter) Log(level slog.Level, msg string, args ...any) {
+	l.mutex.Lock()
+	now := l.clock.Now()
+	if !l.last.IsZero() && now.Sub(l.last) < l.interval {
+		l.repeated++
+		l.mutex.Unlock()
+		return
+	}
+	repeated, since := l.repeated, now.Sub(l.last)
+	l.last = now
+	l.repeated = 0
+	l.mutex.Unlock()
+
+	if repeated > 0 {
+		args = append(args, slog.Int("repeated", repeated), slog.Duration("since", since))
+	}
+	slog.Log(context.Background(), level, msg, args...)
+}
@@ -0,0 +1,64 @@
+package stream
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, receiving the logs of goroutines under test
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// captureLogs redirects the default logger to a buffer for the duration of the test
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	logs := &syncBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+func TestLogLimiter(t *testing.T) {
+	logs := captureLogs(t)
+	clock := NewManualClock(testEpoch)
+	limiter := NewLogLimiter(time.Minute)
+	limiter.clock = clock
+
+	limiter.Log(slog.LevelWarn, "test: Fault")
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Second)
+		limiter.Log(slog.LevelWarn, "test: Fault")
+	}
+	if lines := strings.Count(logs.String(), "test: Fault"); lines != 1 {
+		t.Fatalf("%d lines within the interval, want 1:\n%s", lines, logs)
+	}
+
+	clock.Advance(time.Minute)
+	limiter.Log(slog.LevelWarn, "test: Fault")
+	output := logs.String()
+	if lines := strings.Count(output, "test: Fault"); lines != 2 {
+		t.Fatalf("%d lines after the interval, want 2:\n%s", lines, output)
+	}
+	if !strings.Contains(output, "repeated=5") || !strings.Contains(output, "since=1m5s") {
+		t.Errorf("second line doesn't count the occurrences since the first:\n%s", output)
+	}
+}
@@ -0,0 +1,128 @@
+package stream
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPostRoll = 5 * time.Second
+	maxPreRollSize  = 4 * 1024 * 1024
+)
+
+// MotionDetector returns true if the NAL unit shows motion, e.g. from motion vectors or an external sensor.
+// It is called for every NAL unit, from the goroutine writing the stream: it must be fast.
+type MotionDetector func(nal []byte) bool
+
+// MotionGateOptions defines when a MotionGate lets the stream through
+type MotionGateOptions struct {
+	Detector MotionDetector
+	PreRoll  time.Duration // Video sent from before the motion was detected. It starts at a keyframe, so it can be longer.
+	PostRoll time.Duration // Video sent after the last motion. Defaults to 5 seconds.
+	Clock    Clock         // Defaults to SystemClock
+}
+
+// MotionGate is a writer forwarding the stream only while motion is detected.
+// During still periods, NAL units are discarded, except the ones kept for the pre-roll.
+// When motion resumes, the pre-roll is written first; without pre-roll, units are discarded until the next keyframe,
+// so that the forwarded stream always restarts decodable.
+type MotionGate struct {
+	writer  io.Writer
+	options MotionGateOptions
+
+	mutex           sync.Mutex
+	lastMotion      time.Time
+	open            bool
+	waitingKeyframe bool
+	preRoll         []timedNAL
+	preRollSize     int
+	lastType        uint8
+}
+
+type timedNAL struct {
+	at  time.Time
+	nal []byte
+}
+
+// NewMotionGate creates a gate forwarding the stream to writer while the detector reports motion
+func NewMotionGate(writer io.Writer, options MotionGateOptions) *MotionGate {
+	if options.PostRoll <= 0 {
+		options.PostRoll = defaultPostRoll
+	}
+	if options.Clock == nil {
+		options.Clock = SystemClock
+	}
+	return &MotionGate{writer: writer, options: options}
+}
+
+func (g *MotionGate) Write(nal []byte) (int, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := g.options.Clock.Now()
+	nalType := NALType(nal)
+	keyframeStart := nalType == NALTypeSPS || (nalType == NALTypeIDR && !IsKeyframe(g.lastType))
+	g.lastType = nalType
+
+	if g.options.Detector != nil && g.options.Detector(nal) {
+		g.lastMotion = now
+	}
+	motion := !g.lastMotion.IsZero() && now.Sub(g.lastMotion) <= g.options.PostRoll
+
+	switch {
+	case motion && !g.open:
+		slog.Info("MotionGate: Motion detected; resuming the stream")
+		g.open = true
+		g.waitingKeyframe = len(g.preRoll) == 0
+		for _, buffered := range g.preRoll {
+			if _, err := g.writer.Write(buffered.nal); err != nil {
+				slog.Debug("MotionGate: Error writing the pre-roll", slog.Any("error", err))
+			}
+		}
+		g.clearPreRoll()
+	case !motion && g.open:
+		slog.Info("MotionGate: No more motion; pausing the stream")
+		g.open = false
+	}
+
+	if !g.open {
+		g.buffer(now, nal, keyframeStart)
+		return len(nal), nil
+	}
+	if g.waitingKeyframe {
+		if !keyframeStart {
+			return len(nal), nil
+		}
+		g.waitingKeyframe = false
+	}
+	return g.writer.Write(nal)
+}
+
+// buffer keeps the unit for the pre-roll. The pre-roll always starts at a keyframe.
+func (g *MotionGate) buffer(now time.Time, nal []byte, keyframeStart bool) {
+	if g.options.PreRoll <= 0 {
+		return
+	}
+	if keyframeStart && (len(g.preRoll) == 0 || now.Sub(g.preRoll[0].at) > g.options.PreRoll) {
+		// Start the pre-roll at this keyframe: the previous one is too old
+		g.clearPreRoll()
+	} else if len(g.preRoll) == 0 {
+		// Not decodable without the previous keyframe
+		return
+	}
+	if g.preRollSize+len(nal) > maxPreRollSize {
+		slog.Debug("MotionGate: Pre-roll too big; waiting for the next keyframe")
+		g.clearPreRoll()
+		return
+	}
+	g.preRoll = append(g.preRoll, timedNAL{at: now, nal: bytes.Clone(nal)})
+	g.preRollSize += len(nal)
+}
+
+func (g *MotionGate) clearPreRoll() {
+	g.preRoll = nil
+	g.preRollSize = 0
+}
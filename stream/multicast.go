@@ -0,0 +1,144 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// defaultMulticastTTL keeps the multicast packets on the local network
+const defaultMulticastTTL = 1
+
+// fillerNAL is the shortest filler data unit, which marks the end of an access unit
+var fillerNAL = []byte{0, 0, 0, 1, 0x0c, 0x80}
+
+// MulticastSink sends the NAL units written to it as RTP packets to a UDP address,
+// typically a multicast group joined by passive receivers.
+// Unlike a websocket client, a receiver doesn't keep the camera running: see the streamer options for that.
+type MulticastSink struct {
+	conn       *net.UDPConn
+	packetizer *RTPPacketizer
+	clock      Clock
+	start      time.Time
+	timestamp  uint32
+
+	started  bool // Set once the first unit is written
+	hasSlice bool // Set once the current access unit has a slice: the next unit starting an access unit ends it
+	ttl      int  // Time to live of the multicast packets
+}
+
+// NewMulticastSink creates a sink sending to address, e.g. "239.0.0.1:5004".
+// Multicast packets are sent with a TTL of 1: they stay on the local network. See SetTTL to route them further.
+// On other systems than Linux, they are sent with the system default TTL, usually 1.
+func NewMulticastSink(address string) (*MulticastSink, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &MulticastSink{
+		conn:       conn,
+		packetizer: NewRTPPacketizer(),
+		clock:      SystemClock,
+		start:      SystemClock.Now(),
+	}
+	if err := s.SetTTL(defaultMulticastTTL); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		conn.Close()
+		return nil, err
+	}
+	s.ttl = defaultMulticastTTL
+	return s, nil
+}
+
+// SetTTL sets the time to live of the multicast packets, i.e. the number of routers they may cross,
+// which is announced in the session description. It returns an error wrapping errors.ErrUnsupported on other systems than Linux.
+func (s *MulticastSink) SetTTL(ttl int) error {
+	if ttl < 1 || ttl > 255 {
+		return fmt.Errorf("multicast TTL must be between 1 and 255, not %d", ttl)
+	}
+	if err := setMulticastTTL(s.conn, ttl); err != nil {
+		return fmt.Errorf("multicast TTL: %w", err)
+	}
+	s.ttl = ttl
+	return nil
+}
+
+// Write sends a NAL unit. All the units of an access unit share the timestamp taken at its first unit.
+// The end of an access unit is only known when the next one begins: rather than holding its last slice back
+// until then, which would delay every picture by a frame interval, the units are sent at once and the end
+// is marked by a filler data unit carrying the marker bit, which may follow the slices of a picture.
+func (s *MulticastSink) Write(nal []byte) (int, error) {
+	if s.hasSlice && StartsAccessUnit(nal) {
+		if err := s.send(fillerNAL, s.timestamp, true); err != nil {
+			return 0, err
+		}
+		s.hasSlice = false
+		s.timestamp = s.now()
+	} else if !s.started {
+		s.timestamp = s.now()
+		s.started = true
+	}
+
+	if isVCL(NALType(nal)) {
+		s.hasSlice = true
+	}
+	if err := s.send(nal, s.timestamp, false); err != nil {
+		return 0, err
+	}
+	return len(nal), nil
+}
+
+// now returns the RTP timestamp of the current time
+func (s *MulticastSink) now() uint32 {
+	return uint32(s.clock.Now().Sub(s.start) * rtpClockRate / time.Second)
+}
+
+// send sends the packets of a NAL unit
+func (s *MulticastSink) send(nal []byte, timestamp uint32, marker bool) error {
+	for _, packet := range s.packetizer.Packetize(nal, timestamp, marker) {
+		if _, err := s.conn.Write(packet); err != nil {
+			slog.Debug("MulticastSink: Error sending packet", slog.Any("error", err))
+			return err
+		}
+	}
+	return nil
+}
+
+// SDP returns a session description which receivers such as VLC can open to play the stream.
+// The connection address of a multicast group carries the TTL of the packets, as required by RFC 4566.
+func (s *MulticastSink) SDP() string {
+	addr := s.conn.RemoteAddr().(*net.UDPAddr)
+	addrType := "IP4"
+	if addr.IP.To4() == nil {
+		addrType = "IP6"
+	}
+	connection := addr.IP.String()
+	if addr.IP.IsMulticast() {
+		connection += "/" + strconv.Itoa(s.ttl)
+	}
+	return fmt.Sprintf("v=0\r\n"+
+		"o=- 0 0 IN %[6]s %[1]s\r\n"+
+		"s=go-h264-streamer\r\n"+
+		"c=IN %[6]s %[5]s\r\n"+
+		"t=0 0\r\n"+
+		"m=video %[2]d RTP/AVP %[3]d\r\n"+
+		"a=rtpmap:%[3]d H264/%[4]d\r\n"+
+		"a=fmtp:%[3]d packetization-mode=1\r\n",
+		addr.IP, addr.Port, s.packetizer.PayloadType, rtpClockRate, connection, addrType)
+}
+
+// Close marks the end of the last access unit, which ends the stream, and closes the socket
+func (s *MulticastSink) Close() error {
+	var err error
+	if s.hasSlice {
+		err = s.send(fillerNAL, s.timestamp, true)
+		s.hasSlice = false
+	}
+	return errors.Join(err, s.conn.Close())
+}
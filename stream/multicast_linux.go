@@ -0,0 +1,23 @@
+//go:build linux
+
+package stream
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastTTL sets the time to live of the multicast packets sent through a connection
+func setMulticastTTL(conn *net.UDPConn, ttl int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
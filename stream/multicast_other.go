@@ -0,0 +1,13 @@
+//go:build !linux
+
+package stream
+
+import (
+	"errors"
+	"net"
+)
+
+// setMulticastTTL is only supported on Linux
+func setMulticastTTL(conn *net.UDPConn, ttl int) error {
+	return errors.ErrUnsupported
+}
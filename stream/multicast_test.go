@@ -0,0 +1,140 @@
+package stream
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rtpPacket is the part of an RTP packet checked by the tests
+type rtpPacket struct {
+	marker    bool
+	timestamp uint32
+	payload   []byte
+}
+
+func parseRTP(packet []byte) rtpPacket {
+	return rtpPacket{
+		marker:    packet[1]&0x80 != 0,
+		timestamp: binary.BigEndian.Uint32(packet[4:]),
+		payload:   packet[rtpHeaderSize:],
+	}
+}
+
+func TestMulticastSinkMarker(t *testing.T) {
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	sink, err := NewMulticastSink(receiver.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewManualClock(testEpoch)
+	sink.clock, sink.start = clock, clock.Now()
+
+	// Pictures of two slices
+	units := [][]byte{
+		{0, 0, 0, 1, 0x67, 0x42},
+		{0, 0, 0, 1, 0x68, 0xce},
+		{0, 0, 0, 1, 0x65, 0x88},
+		{0, 0, 0, 1, 0x65, 0x40},
+		{0, 0, 0, 1, 0x41, 0x9a},
+		{0, 0, 0, 1, 0x41, 0x40},
+	}
+	for i, nal := range units {
+		if i == 4 {
+			// The second picture
+			clock.Advance(time.Second)
+		}
+		sink.Write(nal)
+	}
+	// The end of the stream ends the last access unit
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The slices are sent at once: the end of each picture is marked by a filler unit
+	want := []rtpPacket{
+		{false, 0, units[0][4:]},
+		{false, 0, units[1][4:]},
+		{false, 0, units[2][4:]},
+		{false, 0, units[3][4:]},
+		{true, 0, fillerNAL[4:]},
+		{false, rtpClockRate, units[4][4:]},
+		{false, rtpClockRate, units[5][4:]},
+		{true, rtpClockRate, fillerNAL[4:]},
+	}
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 2048)
+	for i, w := range want {
+		n, err := receiver.Read(buffer)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		got := parseRTP(buffer[:n])
+		if got.marker != w.marker || got.timestamp != w.timestamp || string(got.payload) != string(w.payload) {
+			t.Errorf("packet %d: marker %t, timestamp %d, payload %x; want marker %t, timestamp %d, payload %x",
+				i, got.marker, got.timestamp, got.payload, w.marker, w.timestamp, w.payload)
+		}
+	}
+}
+
+func TestPacketizeMarksLastFragment(t *testing.T) {
+	p := NewRTPPacketizer()
+	nal := append([]byte{0, 0, 0, 1, 0x65}, make([]byte, 3*defaultRTPMTU)...)
+	packets := p.Packetize(nal, 0, true)
+	if len(packets) < 3 {
+		t.Fatalf("%d packets, want fragments", len(packets))
+	}
+	for i, packet := range packets {
+		if marker := parseRTP(packet).marker; marker != (i == len(packets)-1) {
+			t.Errorf("fragment %d of %d: marker %t", i+1, len(packets), marker)
+		}
+	}
+}
+
+func TestMulticastSinkSDP(t *testing.T) {
+	sink, err := NewMulticastSink("239.0.0.1:5004")
+	if err != nil {
+		t.Skipf("no multicast route: %v", err)
+	}
+	defer sink.Close()
+
+	if sdp := sink.SDP(); !strings.Contains(sdp, "\r\nc=IN IP4 239.0.0.1/1\r\n") {
+		t.Errorf("SDP without the default TTL:\n%s", sdp)
+	}
+	if err := sink.SetTTL(16); err != nil {
+		t.Fatalf("SetTTL(16) = %v", err)
+	}
+	if sdp := sink.SDP(); !strings.Contains(sdp, "\r\nc=IN IP4 239.0.0.1/16\r\n") {
+		t.Errorf("SDP without the TTL set:\n%s", sdp)
+	}
+	for _, ttl := range []int{0, 256} {
+		if err := sink.SetTTL(ttl); err == nil {
+			t.Errorf("SetTTL(%d) accepted", ttl)
+		}
+	}
+
+	unicast, err := NewMulticastSink("127.0.0.1:5004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unicast.Close()
+	// Only multicast addresses carry a TTL
+	if sdp := unicast.SDP(); !strings.Contains(sdp, "\r\nc=IN IP4 127.0.0.1\r\n") {
+		t.Errorf("unicast SDP:\n%s", sdp)
+	}
+
+	ipv6, err := NewMulticastSink("[::1]:5004")
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	defer ipv6.Close()
+	if sdp := ipv6.SDP(); !strings.Contains(sdp, "\r\no=- 0 0 IN IP6 ::1\r\n") || !strings.Contains(sdp, "\r\nc=IN IP6 ::1\r\n") {
+		t.Errorf("IPv6 SDP:\n%s", sdp)
+	}
+}
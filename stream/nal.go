@@ -0,0 +1,144 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// ErrFrameDropped is returned by writers which dropped a NAL unit, e.g. under load.
+// Writers which may be combined with others, e.g. by io.MultiWriter, should implement DropCounter instead.
+var ErrFrameDropped = errors.New("frame dropped")
+
+// DropCounter is implemented by writers which deliberately drop NAL units, e.g. under load,
+// while their Write succeeds. WriteDrops returns the number of units dropped so far.
+type DropCounter interface {
+	WriteDrops() uint64
+}
+
+// H264 NAL unit types
+const (
+	NALTypeSlice = 1 // Coded slice of a non-IDR picture
+	NALTypeIDR   = 5 // Coded slice of an IDR picture
+	NALTypeSEI   = 6 // Supplemental enhancement information
+	NALTypeSPS   = 7 // Sequence parameter set
+	NALTypePPS   = 8 // Picture parameter set
+	NALTypeAUD   = 9 // Access unit delimiter
+)
+
+var (
+	nalSeparator      = []byte{0, 0, 0, 1}
+	shortNALSeparator = []byte{0, 0, 1}
+)
+
+// NALType returns the type of a NAL unit prefixed by its start code, or 0 if it can't be determined
+func NALType(nal []byte) uint8 {
+	header := 0
+	if bytes.HasPrefix(nal, nalSeparator) {
+		header = len(nalSeparator)
+	} else if bytes.HasPrefix(nal, shortNALSeparator) {
+		header = len(shortNALSeparator)
+	}
+	if header == 0 || len(nal) <= header {
+		return 0
+	}
+	return nal[header] & 0x1f
+}
+
+// IsKeyframe returns true for the NAL types required to start decoding: parameter sets and IDR slices
+func IsKeyframe(nalType uint8) bool {
+	return nalType == NALTypeIDR || nalType == NALTypeSPS || nalType == NALTypePPS
+}
+
+// StartsAccessUnit returns true if a NAL unit prefixed by its start code begins a new access unit:
+// a delimiter, parameter set, SEI, or the first slice of a picture
+func StartsAccessUnit(nal []byte) bool {
+	switch NALType(nal) {
+	case NALTypeAUD, NALTypeSPS, NALTypePPS, NALTypeSEI:
+		return true
+	case NALTypeSlice, NALTypeIDR:
+		return firstSliceOfPicture(nal)
+	}
+	return false
+}
+
+// KeyframeCache keeps the parameter sets and the slices of the latest keyframe of a stream,
+// so that a new client can be primed and display a picture immediately
+type KeyframeCache struct {
+	mutex        sync.Mutex
+	maxSize      int
+	sps          []byte
+	pps          []byte
+	keyframe     [][]byte
+	keyframeSize int
+	overflow     bool
+	lastType     uint8
+}
+
+// NewKeyframeCache creates a cache holding keyframes up to maxSize bytes. Bigger keyframes are not cached.
+func NewKeyframeCache(maxSize int) *KeyframeCache {
+	return &KeyframeCache{maxSize: maxSize}
+}
+
+// Add updates the cache with a NAL unit of the stream
+func (c *KeyframeCache) Add(nal []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	nalType := NALType(nal)
+	switch nalType {
+	case NALTypeSPS:
+		c.sps = bytes.Clone(nal)
+	case NALTypePPS:
+		c.pps = bytes.Clone(nal)
+	case NALTypeIDR:
+		if c.lastType != NALTypeIDR {
+			// First slice of a new keyframe
+			c.keyframe = nil
+			c.keyframeSize = 0
+			c.overflow = false
+		}
+		if c.overflow || c.keyframeSize+len(nal) > c.maxSize {
+			c.keyframe = nil
+			c.keyframeSize = 0
+			c.overflow = true
+		} else {
+			c.keyframe = append(c.keyframe, bytes.Clone(nal))
+			c.keyframeSize += len(nal)
+		}
+	}
+	c.lastType = nalType
+}
+
+// Write adds a NAL unit to the cache, so that the cache can be a sink of the stream
+func (c *KeyframeCache) Write(nal []byte) (int, error) {
+	c.Add(nal)
+	return len(nal), nil
+}
+
+// NALs returns the cached SPS, PPS and keyframe slices, in decoding order.
+// Nothing is returned until both parameter sets are known.
+func (c *KeyframeCache) NALs() [][]byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.sps == nil || c.pps == nil {
+		return nil
+	}
+	nals := make([][]byte, 0, 2+len(c.keyframe))
+	nals = append(nals, c.sps, c.pps)
+	return append(nals, c.keyframe...)
+}
+
+// Reset empties the cache
+func (c *KeyframeCache) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.sps = nil
+	c.pps = nil
+	c.keyframe = nil
+	c.keyframeSize = 0
+	c.overflow = false
+	c.lastType = 0
+}
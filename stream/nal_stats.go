@@ -0,0 +1,66 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// nalStats counts the NAL units written to it by type, and periodically logs a summary
+type nalStats struct {
+	writer io.Writer
+
+	idr    atomic.Uint64
+	slices atomic.Uint64
+	sps    atomic.Uint64
+	pps    atomic.Uint64
+	sei    atomic.Uint64
+	other  atomic.Uint64
+}
+
+func (s *nalStats) Write(nal []byte) (int, error) {
+	switch NALType(nal) {
+	case NALTypeIDR:
+		s.idr.Add(1)
+	case NALTypeSlice:
+		s.slices.Add(1)
+	case NALTypeSPS:
+		s.sps.Add(1)
+	case NALTypePPS:
+		s.pps.Add(1)
+	case NALTypeSEI:
+		s.sei.Add(1)
+	default:
+		s.other.Add(1)
+	}
+	return s.writer.Write(nal)
+}
+
+// run logs the counts over the last interval until ctx is cancelled
+func (s *nalStats) run(ctx context.Context, interval time.Duration, clock Clock) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			idr := s.idr.Swap(0)
+			slog.Info("nalStats: NAL units over the last interval",
+				slog.Duration("interval", interval),
+				slog.Uint64("idr", idr),
+				slog.Uint64("slices", s.slices.Swap(0)),
+				slog.Uint64("sps", s.sps.Swap(0)),
+				slog.Uint64("pps", s.pps.Swap(0)),
+				slog.Uint64("sei", s.sei.Swap(0)),
+				slog.Uint64("other", s.other.Swap(0)),
+			)
+			if idr == 0 {
+				slog.Warn("nalStats: No keyframe over the last interval", slog.Duration("interval", interval))
+			}
+		}
+	}
+}
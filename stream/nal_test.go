@@ -0,0 +1,30 @@
+package stream
+
+import "testing"
+
+func TestStartsAccessUnit(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		nal  []byte
+		want bool
+	}{
+		{"AUD", []byte{0, 0, 0, 1, 0x09, 0xf0}, true},
+		{"SPS", []byte{0, 0, 0, 1, 0x67, 0x42}, true},
+		{"PPS", []byte{0, 0, 0, 1, 0x68, 0xce}, true},
+		{"SEI", []byte{0, 0, 0, 1, 0x06, 0x05}, true},
+		{"first slice of an IDR picture", []byte{0, 0, 0, 1, 0x65, 0x88}, true},
+		{"next slice of an IDR picture", []byte{0, 0, 0, 1, 0x65, 0x40}, false},
+		{"first slice", []byte{0, 0, 0, 1, 0x41, 0x9a}, true},
+		{"next slice", []byte{0, 0, 0, 1, 0x41, 0x40}, false},
+		{"first slice after a short start code", []byte{0, 0, 1, 0x41, 0x9a}, true},
+		{"next slice after a short start code", []byte{0, 0, 1, 0x41, 0x40}, false},
+		{"slice without payload", []byte{0, 0, 0, 1, 0x41}, false},
+		{"no start code", []byte{0x41, 0x9a}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StartsAccessUnit(tt.nal); got != tt.want {
+				t.Errorf("StartsAccessUnit(%x) = %t, want %t", tt.nal, got, tt.want)
+			}
+		})
+	}
+}
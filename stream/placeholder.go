@@ -0,0 +1,30 @@
+package stream
+
+import (
+	"fmt"
+	"os"
+)
+
+// LoadPlaceholder reads a picture shown by clients until the stream produces one, e.g. a black frame
+// or a "connecting..." slate, from an H264 Annex B file. The file must be decodable on its own:
+// it must contain an SPS, a PPS and an IDR picture, which are returned in decoding order.
+// Such a file can be made with ffmpeg, for instance:
+//
+//	ffmpeg -f lavfi -i color=black:s=960x540 -frames:v 1 -c:v libx264 -profile:v baseline placeholder.h264
+func LoadPlaceholder(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := NewKeyframeCache(len(data))
+	splitter := newNALSplitter(SplitterOptions{MatchShortSeparator: true}, cache, len(data))
+	splitter.Write(data)
+	splitter.flush()
+
+	nals := cache.NALs()
+	if !hasKeyframe(nals) {
+		return nil, fmt.Errorf("invalid placeholder %s: %w", path, ErrNoKeyframe)
+	}
+	return nals, nil
+}
@@ -0,0 +1,53 @@
+package stream
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+)
+
+// I/O scheduling classes, as used by ionice
+const (
+	IONiceRealtime   = 1
+	IONiceBestEffort = 2
+	IONiceIdle       = 3
+)
+
+// validatePriority checks the Nice and IONice options
+func (options CameraOptions) validatePriority() error {
+	var errs []error
+	if (options.Nice != 0 || options.IONice != 0) && runtime.GOOS != "linux" {
+		errs = append(errs, errors.New("process priority is only supported on Linux"))
+	}
+	if options.Nice < -20 || options.Nice > 19 {
+		errs = append(errs, errors.New("nice must be between -20 and 19"))
+	}
+	if options.IONice < 0 || options.IONice > IONiceIdle {
+		errs = append(errs, errors.New("unknown I/O scheduling class"))
+	}
+	if options.IONiceLevel < 0 || options.IONiceLevel > 7 {
+		errs = append(errs, errors.New("I/O priority level must be between 0 and 7"))
+	}
+	if options.IONiceLevel != 0 && options.IONice != IONiceRealtime && options.IONice != IONiceBestEffort {
+		errs = append(errs, errors.New("I/O priority level requires the realtime or best-effort class"))
+	}
+	return errors.Join(errs...)
+}
+
+// wrapPriority prefixes the command with nice and ionice invocations if a priority is set.
+// Both tools exec the wrapped command, so the priorities apply to the camera process itself.
+func wrapPriority(options CameraOptions, command string, args []string) (string, []string) {
+	if options.Nice != 0 {
+		args = append([]string{"-n", strconv.Itoa(options.Nice), command}, args...)
+		command = "nice"
+	}
+	if options.IONice != 0 {
+		prefix := []string{"-c", strconv.Itoa(options.IONice)}
+		if options.IONice != IONiceIdle {
+			prefix = append(prefix, "-n", strconv.Itoa(options.IONiceLevel))
+		}
+		args = append(append(prefix, command), args...)
+		command = "ionice"
+	}
+	return command, args
+}
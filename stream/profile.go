@@ -0,0 +1,89 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+)
+
+// ErrUnknownProfile is returned when switching to a profile which isn't registered
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// Profiles are camera options by name, e.g. "day", "night", "event"
+type Profiles map[string]CameraOptions
+
+// SetProfiles validates and registers the profiles, replacing the previous ones
+func (s *Streamer) SetProfiles(profiles Profiles) error {
+	for name, options := range profiles {
+		if err := options.Validate(); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.profiles = maps.Clone(profiles)
+	return nil
+}
+
+// ProfileNames returns the names of the registered profiles, sorted
+func (s *Streamer) ProfileNames() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := make([]string, 0, len(s.profiles))
+	for name := range s.profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Profile returns the name of the current profile, or "" if the options weren't set by a profile
+func (s *Streamer) Profile() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.profile
+}
+
+// SwitchProfile applies the options of a registered profile like Reconfigure, restarting the camera if it is running.
+// The hooks which can't be defined in JSON (ConfigureCommand, NALFilter, Source, Splitter, OnEvent, SameKeyframes)
+// are kept from the current options when the profile doesn't set them.
+func (s *Streamer) SwitchProfile(name string) error {
+	s.mutex.Lock()
+	options, ok := s.profiles[name]
+	current := s.options
+	s.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+	}
+
+	if options.ConfigureCommand == nil {
+		options.ConfigureCommand = current.ConfigureCommand
+	}
+	if options.NALFilter == nil {
+		options.NALFilter = current.NALFilter
+	}
+	if options.Source == nil {
+		options.Source = current.Source
+	}
+	if len(options.Splitter.Separator) == 0 {
+		options.Splitter = current.Splitter
+	}
+	if options.OnEvent == nil {
+		options.OnEvent = current.OnEvent
+	}
+	if options.SameKeyframes == nil {
+		options.SameKeyframes = current.SameKeyframes
+	}
+
+	if _, err := s.reconfigure(options, name); err != nil {
+		return err
+	}
+	slog.Info("Streamer: Switched profile", slog.String("profile", name))
+	return nil
+}
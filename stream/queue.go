@@ -0,0 +1,161 @@
+package stream
+
+import (
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+var queueDropLog = NewLogLimiter(RepeatedLogInterval)
+
+// nalQueue is a bounded queue of NAL units between the camera reader and a writer, so that a writer which is
+// momentarily slow doesn't stall the reading of the camera. When it is full, the oldest unit which isn't needed
+// to start decoding (SPS, PPS and IDR slices are) is dropped, and so are the slices following it until the next keyframe,
+// as they reference it. If it only holds keyframes, the oldest one is dropped, as the newer ones replace it:
+// it never holds more than maxSize units.
+type nalQueue struct {
+	writer  io.Writer
+	maxSize int
+
+	mutex           sync.Mutex
+	ready           *sync.Cond // Signaled when a unit is queued or the queue is closed
+	units           [][]byte
+	closed          bool
+	waitingKeyframe bool // Set after a drop: slices are dropped until the next IDR
+	dropped         uint64
+}
+
+func newNALQueue(writer io.Writer, maxSize int) *nalQueue {
+	q := &nalQueue{writer: writer, maxSize: maxSize}
+	q.ready = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Write queues a unit. It never blocks.
+func (q *nalQueue) Write(nal []byte) (int, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	nalType := NALType(nal)
+	if len(q.units) >= q.maxSize && !q.dropOldest() {
+		if !IsKeyframe(nalType) {
+			// Only keyframes are queued: drop this unit rather than the ones needed to start decoding
+			q.waitingKeyframe = q.waitingKeyframe || isVCL(nalType)
+			q.drop()
+			return len(nal), nil
+		}
+		q.dropOldestKeyframe()
+	}
+	if q.waitingKeyframe {
+		if nalType == NALTypeIDR && firstSliceOfPicture(nal) {
+			q.waitingKeyframe = false
+		} else if isVCL(nalType) {
+			q.drop()
+			return len(nal), nil
+		}
+	}
+	q.units = append(q.units, nal)
+	q.ready.Signal()
+	return len(nal), nil
+}
+
+// dropOldest drops the oldest slice which isn't part of a keyframe, and the slices following it up to the next IDR,
+// which can't be decoded without it. If there is no IDR in the queue, the next slices are dropped as well, up to the next one.
+// It returns false if there is no such slice.
+func (q *nalQueue) dropOldest() bool {
+	first := slices.IndexFunc(q.units, func(nal []byte) bool {
+		nalType := NALType(nal)
+		return isVCL(nalType) && nalType != NALTypeIDR
+	})
+	if first < 0 {
+		return false
+	}
+	kept := q.units[:first]
+	q.waitingKeyframe = true
+	for i, nal := range q.units[first:] {
+		nalType := NALType(nal)
+		if nalType == NALTypeIDR {
+			// Decodable again from there
+			q.waitingKeyframe = false
+			kept = append(kept, q.units[first+i:]...)
+			break
+		}
+		if isVCL(nalType) {
+			q.drop()
+		} else {
+			kept = append(kept, nal)
+		}
+	}
+	clear(q.units[len(kept):])
+	q.units = kept
+	return true
+}
+
+// dropOldestKeyframe drops the units of the oldest keyframe of a queue holding only keyframes, up to the parameter sets
+// of the next one. If the queue ends with the slices of a single keyframe, they are dropped, and so are the slices
+// of its picture which are still to come.
+func (q *nalQueue) dropOldestKeyframe() {
+	end := len(q.units)
+	start := 0 // First unit after the latest slice
+	for i, nal := range q.units {
+		nalType := NALType(nal)
+		if nalType == NALTypeIDR && firstSliceOfPicture(nal) && start > 0 {
+			end = start
+			break
+		}
+		if isVCL(nalType) {
+			start = i + 1
+		}
+	}
+	if end == len(q.units) && start > 0 {
+		// The parameter sets following the latest slice belong to the next keyframe
+		end = start
+	}
+	for _, nal := range q.units[:end] {
+		if isVCL(NALType(nal)) {
+			q.drop()
+		}
+	}
+	if end == len(q.units) && start == end {
+		// The rest of the picture of the latest slice can't be decoded
+		q.waitingKeyframe = true
+	}
+	n := copy(q.units, q.units[end:])
+	clear(q.units[n:])
+	q.units = q.units[:n]
+}
+
+func (q *nalQueue) drop() {
+	q.dropped++
+	queueDropLog.Log(slog.LevelWarn, "nalQueue: Queue full; dropping NAL units until the next keyframe", slog.Uint64("dropped", q.dropped))
+}
+
+// run writes the queued units to the writer until the queue is closed and empty
+func (q *nalQueue) run() {
+	for {
+		q.mutex.Lock()
+		for len(q.units) == 0 && !q.closed {
+			q.ready.Wait()
+		}
+		if len(q.units) == 0 {
+			q.mutex.Unlock()
+			return
+		}
+		nal := q.units[0]
+		q.units[0] = nil
+		q.units = q.units[1:]
+		q.mutex.Unlock()
+
+		q.writer.Write(nal)
+	}
+}
+
+// close makes run return once the queued units are written
+func (q *nalQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.ready.Signal()
+}
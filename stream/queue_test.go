@@ -0,0 +1,70 @@
+package stream
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestNALQueueCap(t *testing.T) {
+	sps, pps := []byte{0, 0, 0, 1, 0x67, 0x42}, []byte{0, 0, 0, 1, 0x68, 0xce}
+	idr := func(id byte) []byte { return []byte{0, 0, 0, 1, 0x65, 0x88, id} }
+	idrNext := func(id byte) []byte { return []byte{0, 0, 0, 1, 0x65, 0x40, id} } // Second slice of the picture
+	slice := func(id byte) []byte { return []byte{0, 0, 0, 1, 0x41, 0x9a, id} }
+
+	for _, tt := range []struct {
+		name    string
+		maxSize int
+		written [][]byte
+		want    [][]byte
+		dropped uint64
+	}{
+		{
+			name:    "slices dropped first",
+			maxSize: 4,
+			written: [][]byte{sps, pps, idr(1), slice(2), slice(3)},
+			// The slice is dropped, and the next one which references it
+			want:    [][]byte{sps, pps, idr(1)},
+			dropped: 2,
+		},
+		{
+			name:    "oldest keyframe dropped",
+			maxSize: 4,
+			written: [][]byte{sps, pps, idr(1), sps, pps, idr(2)},
+			want:    [][]byte{sps, pps, idr(2)},
+			dropped: 1,
+		},
+		{
+			name:    "keyframes of several slices",
+			maxSize: 5,
+			written: [][]byte{idr(1), idrNext(1), sps, pps, idr(2), idrNext(2), sps, pps, idr(3)},
+			want:    [][]byte{sps, pps, idr(3)},
+			dropped: 4,
+		},
+		{
+			name:    "single keyframe bigger than the queue",
+			maxSize: 3,
+			written: [][]byte{sps, pps, idr(1), idrNext(1), idrNext(1), slice(2), idr(3)},
+			// Its picture can't be completed: the slices are dropped up to the next keyframe
+			want:    [][]byte{idr(3)},
+			dropped: 4,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newNALQueue(io.Discard, tt.maxSize)
+			for _, nal := range tt.written {
+				q.Write(nal)
+				if len(q.units) > tt.maxSize {
+					t.Fatalf("%d units queued, more than %d", len(q.units), tt.maxSize)
+				}
+			}
+			if !slices.EqualFunc(q.units, tt.want, bytes.Equal) {
+				t.Errorf("queued\n%x\nwant\n%x", q.units, tt.want)
+			}
+			if q.dropped != tt.dropped {
+				t.Errorf("%d units dropped, want %d", q.dropped, tt.dropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// RawFrames runs the camera in uncompressed YUV420 mode and calls onFrame with each frame,
+// until ctx is cancelled or the camera stops. It is meant for on-device analytics, e.g. motion detection,
+// without decoding H264, and can't run at the same time as the video stream. libcamera only.
+//
+// A frame holds the Y plane followed by the U and V planes: Width*Height*3/2 bytes.
+// libcamera pads the rows of the planes to its buffer stride: use a width multiple of 64 to get unpadded frames.
+// The frame buffer is reused: onFrame must not keep it after returning.
+func RawFrames(ctx context.Context, options CameraOptions, onFrame func(frame []byte)) error {
+	if err := options.Validate(); err != nil {
+		return fmt.Errorf("invalid camera options: %w", err)
+	}
+	if options.Width <= 0 || options.Height <= 0 {
+		return errors.New("raw frames require the width and height")
+	}
+	backend, err := determineBackend(options)
+	if err != nil {
+		return err
+	}
+	if !backend.isLibcamera() {
+		return fmt.Errorf("raw frames are not supported by %s", backend)
+	}
+
+	options.Codec = codecYUV420
+	source := &commandSource{
+		command:   string(backend),
+		args:      buildArgs(options, backend),
+		configure: options.ConfigureCommand,
+	}
+	reader, err := source.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	frame := make([]byte, options.Width*options.Height*3/2)
+	for {
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("reading raw frame: %w", err)
+		}
+		onFrame(frame)
+	}
+}
@@ -0,0 +1,63 @@
+package stream
+
+import (
+	"errors"
+	"time"
+)
+
+// Defaults of the RestartPolicy fields
+const (
+	defaultRestartInitialDelay = time.Second
+	defaultRestartMaxDelay     = 30 * time.Second
+	defaultRestartMultiplier   = 2
+)
+
+// RestartPolicy defines how the camera is restarted when it fails while clients are connected.
+// The delay before a restart starts at InitialDelay and is multiplied by Multiplier after each failure,
+// up to MaxDelay. The attempts are counted again from zero once the camera ran for longer than MaxDelay.
+type RestartPolicy struct {
+	InitialDelay Duration `json:"initialDelay"` // Delay before the first restart. Defaults to 1 second.
+	MaxDelay     Duration `json:"maxDelay"`     // Maximum delay between restarts. Defaults to 30 seconds.
+	Multiplier   float64  `json:"multiplier"`   // Growth factor of the delay. Defaults to 2.
+	MaxAttempts  int      `json:"maxAttempts"`  // Number of consecutive restarts before giving up. 0 retries forever.
+}
+
+func (policy RestartPolicy) validate() error {
+	var errs []error
+	if policy.InitialDelay < 0 || policy.MaxDelay < 0 {
+		errs = append(errs, errors.New("restart delays must not be negative"))
+	}
+	if policy.Multiplier != 0 && policy.Multiplier < 1 {
+		errs = append(errs, errors.New("restart multiplier must be at least 1"))
+	}
+	if policy.MaxAttempts < 0 {
+		errs = append(errs, errors.New("restart attempts must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// withDefaults returns the policy with its unset fields replaced by their defaults
+func (policy RestartPolicy) withDefaults() RestartPolicy {
+	if policy.InitialDelay == 0 {
+		policy.InitialDelay = Duration(defaultRestartInitialDelay)
+	}
+	if policy.MaxDelay == 0 {
+		policy.MaxDelay = Duration(defaultRestartMaxDelay)
+	}
+	if policy.MaxDelay < policy.InitialDelay {
+		policy.MaxDelay = policy.InitialDelay
+	}
+	if policy.Multiplier == 0 {
+		policy.Multiplier = defaultRestartMultiplier
+	}
+	return policy
+}
+
+// delay returns the delay before the given restart attempt, counted from 0
+func (policy RestartPolicy) delay(attempt int) time.Duration {
+	delay := float64(policy.InitialDelay)
+	for i := 0; i < attempt && delay < float64(policy.MaxDelay); i++ {
+		delay *= policy.Multiplier
+	}
+	return min(time.Duration(delay), time.Duration(policy.MaxDelay))
+}
@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+)
+
+const (
+	rtpHeaderSize     = 12
+	rtpClockRate      = 90000 // Clock rate of H264 RTP timestamps
+	defaultRTPMTU     = 1400
+	defaultRTPPayload = 96
+	fuaType           = 28
+)
+
+// RTPPacketizer packs H264 NAL units into RTP packets as defined by RFC 6184,
+// using single NAL unit packets and FU-A fragmentation for units bigger than the MTU
+type RTPPacketizer struct {
+	PayloadType uint8  // Dynamic payload type announced to receivers, 96 by default
+	SSRC        uint32 // Synchronization source identifier
+	MTU         int    // Maximum size of a packet, 1400 bytes by default
+
+	sequence uint16
+}
+
+// NewRTPPacketizer creates a packetizer with a random SSRC and initial sequence number
+func NewRTPPacketizer() *RTPPacketizer {
+	return &RTPPacketizer{
+		PayloadType: defaultRTPPayload,
+		SSRC:        rand.Uint32(),
+		MTU:         defaultRTPMTU,
+		sequence:    uint16(rand.Uint32()),
+	}
+}
+
+// Packetize returns the RTP packets carrying a NAL unit, with or without its start code.
+// marker must be set for the last NAL unit of an access unit.
+func (p *RTPPacketizer) Packetize(nal []byte, timestamp uint32, marker bool) [][]byte {
+	nal = trimStartCode(nal)
+	if len(nal) == 0 {
+		return nil
+	}
+
+	maxPayload := p.MTU - rtpHeaderSize
+	if len(nal) <= maxPayload {
+		packet := p.header(timestamp, marker, len(nal))
+		return [][]byte{append(packet, nal...)}
+	}
+
+	// FU-A fragmentation: the NAL header is split between the FU indicator and the FU header
+	indicator := nal[0]&0xe0 | fuaType
+	nalType := nal[0] & 0x1f
+	payload := nal[1:]
+	maxFragment := maxPayload - 2
+
+	var packets [][]byte
+	for start := true; len(payload) > 0; start = false {
+		size := min(len(payload), maxFragment)
+		end := size == len(payload)
+
+		fuHeader := nalType
+		if start {
+			fuHeader |= 0x80
+		}
+		if end {
+			fuHeader |= 0x40
+		}
+
+		packet := p.header(timestamp, marker && end, size+2)
+		packet = append(packet, indicator, fuHeader)
+		packet = append(packet, payload[:size]...)
+		packets = append(packets, packet)
+		payload = payload[size:]
+	}
+	return packets
+}
+
+// header returns the RTP header of the next packet, with room for the payload
+func (p *RTPPacketizer) header(timestamp uint32, marker bool, payloadSize int) []byte {
+	packet := make([]byte, rtpHeaderSize, rtpHeaderSize+payloadSize)
+	packet[0] = 0x80 // Version 2, no padding, no extension, no CSRC
+	packet[1] = p.PayloadType & 0x7f
+	if marker {
+		packet[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(packet[2:], p.sequence)
+	binary.BigEndian.PutUint32(packet[4:], timestamp)
+	binary.BigEndian.PutUint32(packet[8:], p.SSRC)
+	p.sequence++
+	return packet
+}
+
+// trimStartCode removes the Annex B start code of a NAL unit, if any
+func trimStartCode(nal []byte) []byte {
+	if bytes.HasPrefix(nal, nalSeparator) {
+		return nal[len(nalSeparator):]
+	}
+	return bytes.TrimPrefix(nal, shortNALSeparator)
+}
+
+// isVCL returns true for the NAL types carrying picture data
+func isVCL(nalType uint8) bool {
+	return nalType >= NALTypeSlice && nalType <= NALTypeIDR
+}
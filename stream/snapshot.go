@@ -0,0 +1,153 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// snapshotWaitDelay bounds the wait for the output of a killed still process
+const (
+	snapshotWaitDelay   = time.Second
+	snapshotCacheSizeKB = 1024
+
+	defaultMaxSnapshots = 1
+	defaultSnapshotWait = 5 * time.Second
+)
+
+// ErrTooManySnapshots is returned when a snapshot couldn't start because the maximum number of snapshots
+// were in progress for the whole waiting time
+var ErrTooManySnapshots = errors.New("too many snapshots in progress")
+
+// stillCaptures serializes the still capture processes: the camera can only be used by one at a time
+var stillCaptures = newSnapshotLimiter(1, defaultSnapshotWait, SystemClock)
+
+// snapshotLimiter limits the number of concurrent snapshots. The excess requests wait for a slot,
+// up to a maximum duration.
+type snapshotLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+	clock Clock
+}
+
+func newSnapshotLimiter(concurrent int, wait time.Duration, clock Clock) *snapshotLimiter {
+	return &snapshotLimiter{slots: make(chan struct{}, concurrent), wait: wait, clock: clock}
+}
+
+// acquire waits for a slot. It returns ErrTooManySnapshots if none freed up in time, or the error of ctx.
+// The slot must be given back with release.
+func (l *snapshotLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-l.clock.After(l.wait):
+		return ErrTooManySnapshots
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *snapshotLimiter) release() {
+	<-l.slots
+}
+
+// Snapshot captures a JPEG still image with the still capture tool of the backend.
+// The camera can't be used by the video stream at the same time.
+// Captures are serialized: a capture waits up to 5 seconds for the previous ones, then fails with ErrTooManySnapshots.
+// If ctx is cancelled or its deadline expires, the capture process is killed and the context error is returned.
+func Snapshot(ctx context.Context, options CameraOptions) ([]byte, error) {
+	if err := options.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid camera options: %w", err)
+	}
+
+	backend, err := determineBackend(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := stillCaptures.acquire(ctx); err != nil {
+		return nil, fmt.Errorf("snapshot: %w", err)
+	}
+	defer stillCaptures.release()
+
+	args := []string{
+		"-t", "1", // Capture immediately
+		"-n", // Do not show a preview window
+		"-e", "jpg",
+		"-o", "-", // Output to stdout
+	}
+	if options.Width != 0 && options.Height != 0 {
+		args = append(args, "--width", strconv.Itoa(options.Width), "--height", strconv.Itoa(options.Height))
+	}
+	if options.HorizontalFlip {
+		args = append(args, "--hflip")
+	}
+	if options.VerticalFlip {
+		args = append(args, "--vflip")
+	}
+	if options.Rotation != 0 {
+		args = append(args, "--rotation", strconv.Itoa(options.Rotation))
+	}
+	if options.TuningFile != "" && backend.supports("TuningFile") {
+		args = append(args, "--tuning-file", options.TuningFile)
+	}
+
+	cmd := exec.CommandContext(ctx, backend.stillCommand(), args...)
+	// Don't wait forever for the output pipes if the killed process left children holding them
+	cmd.WaitDelay = snapshotWaitDelay
+	var stdout bytes.Buffer
+	stderr := &tailBuffer{size: stderrTailSize}
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("snapshot: %w", ctx.Err())
+		}
+		if stderr.contains(cameraBusyMessages) {
+			return nil, fmt.Errorf("snapshot: %w", errCameraBusy)
+		}
+		return nil, fmt.Errorf("snapshot: %w: %s", err, stderr)
+	}
+	return stdout.Bytes(), nil
+}
+
+// SnapshotFromStream returns a JPEG image of the latest keyframe of the running stream, decoded with ffmpeg.
+// Unlike Snapshot, it doesn't access the camera, so it doesn't conflict with the video stream.
+// It returns ErrNoKeyframe if the camera isn't running or hasn't produced a keyframe yet.
+// The picture is as old as the keyframe: up to the intra period.
+// The number of concurrent decodes is limited, see SetSnapshotLimit.
+func (s *Streamer) SnapshotFromStream(ctx context.Context) ([]byte, error) {
+	s.mutex.Lock()
+	limiter := s.snapshots
+	s.mutex.Unlock()
+
+	if err := limiter.acquire(ctx); err != nil {
+		return nil, fmt.Errorf("snapshot: %w", err)
+	}
+	defer limiter.release()
+	return DecodeJPEG(ctx, s.keyframes.NALs())
+}
+
+// SetSnapshotLimit sets the maximum number of concurrent SnapshotFromStream decodes, 1 by default,
+// and how long the excess requests wait for a decode to complete before failing with ErrTooManySnapshots,
+// 5 seconds by default. Decodes in progress are not counted by the new limit.
+func (s *Streamer) SetSnapshotLimit(concurrent int, wait time.Duration) {
+	if concurrent <= 0 {
+		concurrent = defaultMaxSnapshots
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.snapshots = newSnapshotLimiter(concurrent, wait, s.clock)
+}
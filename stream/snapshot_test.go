@@ -0,0 +1,39 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSnapshotLimiterWait(t *testing.T) {
+	clock := NewManualClock(testEpoch)
+	limiter := newSnapshotLimiter(1, 5*time.Second, clock)
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The excess request waits on the clock, and gets the slot once it is released
+	acquired := make(chan error, 1)
+	go func() { acquired <- limiter.acquire(context.Background()) }()
+	clock.WaitForTimers(1)
+	clock.Advance(4 * time.Second)
+	limiter.release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("acquire after a release: %v", err)
+	}
+
+	// Until the waiting time expires. The timer of the previous wait is still pending.
+	go func() { acquired <- limiter.acquire(context.Background()) }()
+	clock.WaitForTimers(2)
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquire returned %v before the waiting time", err)
+	default:
+	}
+	clock.Advance(5 * time.Second)
+	if err := <-acquired; !errors.Is(err, ErrTooManySnapshots) {
+		t.Errorf("acquire = %v, want ErrTooManySnapshots", err)
+	}
+}
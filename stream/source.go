@@ -0,0 +1,97 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+)
+
+// Source produces an H264 Annex B byte stream, like the camera
+type Source interface {
+	// Open starts the source. The stream ends when the reader returns io.EOF or ctx is cancelled.
+	// Closing the reader stops the source.
+	Open(ctx context.Context) (io.ReadCloser, error)
+}
+
+// runSource reads a source until ctx is cancelled or its stream ends, and splits it into NAL units.
+// It returns errCameraBusy if the source terminated because the camera was held by another process.
+func runSource(ctx context.Context, source Source, options CameraOptions, writer io.Writer, clock Clock) error {
+	reader, err := source.Open(ctx)
+	if err != nil {
+		return err
+	}
+	options.OnEvent.Emit(clock, Event{Type: EventCameraStarted})
+
+	err = readCamera(ctx, reader, options, writer, clock)
+	closeErr := reader.Close()
+	options.OnEvent.Emit(clock, Event{Type: EventCameraStopped})
+	if err == nil && ctx.Err() == nil {
+		// Terminated by itself: report why
+		err = closeErr
+	}
+	return err
+}
+
+// commandSource is a source reading the standard output of a command
+type commandSource struct {
+	command   string
+	args      []string
+	configure func(cmd *exec.Cmd)
+}
+
+func (s *commandSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, s.command, s.args...)
+
+	stderr := &tailBuffer{size: stderrTailSize}
+	cmd.Stderr = stderr
+
+	if s.configure != nil {
+		s.configure(cmd)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("getting stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("starting camera: %w", err)
+	}
+	slog.Debug("commandSource: Started command", slog.String("command", s.command), slog.Any("args", s.args))
+
+	return &commandReader{
+		Reader: stdout,
+		cmd:    cmd,
+		cancel: cancel,
+		stderr: stderr,
+	}, nil
+}
+
+// commandReader reads the standard output of a running command
+type commandReader struct {
+	io.Reader
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stderr *tailBuffer
+}
+
+// Close kills the command if it is still running and waits for its termination.
+// It returns errCameraBusy if the command complained that the camera was held by another process,
+// and errCameraExited if it terminated by itself.
+func (r *commandReader) Close() error {
+	r.cancel()
+	r.cmd.Wait()
+
+	if r.stderr.contains(cameraBusyMessages) {
+		return errCameraBusy
+	}
+	if state := r.cmd.ProcessState; state != nil && state.Exited() {
+		// Not killed by the cancellation
+		return fmt.Errorf("%w: %s", errCameraExited, state)
+	}
+	return nil
+}
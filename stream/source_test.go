@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+)
+
+// fakeSource is a Source standing in for the camera: it produces stream, then stays open until it is stopped.
+// If err is set, opening it fails instead. If closeErr or ends is set, the stream ends after stream,
+// and closing the reader returns closeErr, like a command exiting by itself. It counts the opens and the readers not closed yet.
+type fakeSource struct {
+	stream   []byte
+	err      error
+	closeErr error
+	ends     bool
+
+	opens   atomic.Int32
+	readers atomic.Int32
+}
+
+func (s *fakeSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	s.opens.Add(1)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	reader, writer := io.Pipe()
+	go func() {
+		writer.Write(s.stream)
+		if s.closeErr == nil && !s.ends {
+			<-ctx.Done()
+		}
+		writer.Close()
+	}()
+	s.readers.Add(1)
+	return &fakeReader{PipeReader: reader, cancel: cancel, source: s}, nil
+}
+
+type fakeReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+	source *fakeSource
+}
+
+func (r *fakeReader) Close() error {
+	r.cancel()
+	r.PipeReader.Close()
+	r.source.readers.Add(-1)
+	return r.source.closeErr
+}
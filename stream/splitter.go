@@ -0,0 +1,133 @@
+package stream
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+)
+
+// SplitterOptions defines how the output of a source is cut into units before being broadcast
+type SplitterOptions struct {
+	Separator           []byte // Delimiter at the start of each unit. If empty, the H264 start code is used.
+	MatchShortSeparator bool   // Also cut on the 3-byte start code {0,0,1}. Only meaningful for H264/HEVC streams.
+}
+
+// H264Splitter splits H264 Annex B streams on the 4-byte start code
+var H264Splitter = SplitterOptions{Separator: []byte{0, 0, 0, 1}}
+
+var oversizedUnitLog = NewLogLimiter(RepeatedLogInterval)
+
+// nalSplitter accumulates a byte stream and writes it unit by unit to the writer
+type nalSplitter struct {
+	options    SplitterOptions
+	writer     io.Writer
+	buffer     []byte
+	currentPos int
+	synced     bool // Set once the buffer starts at a separator: data before the first one is a partial unit
+}
+
+func newNALSplitter(options SplitterOptions, writer io.Writer, bufferSize int) *nalSplitter {
+	if len(options.Separator) == 0 {
+		options.Separator = H264Splitter.Separator
+	}
+	return &nalSplitter{
+		options: options,
+		writer:  writer,
+		buffer:  make([]byte, bufferSize),
+	}
+}
+
+// Write buffers p and writes every complete unit it terminates
+// An error of the writer doesn't stop the processing of p: the first one is returned once p has been consumed.
+func (s *nalSplitter) Write(p []byte) (int, error) {
+	written := len(p)
+	var writeErr error
+
+	for len(p) > 0 {
+		if s.currentPos == len(s.buffer) {
+			oversizedUnitLog.Log(slog.LevelWarn, "nalSplitter: Unit bigger than buffer; dropping it", slog.Int("bufferSize", len(s.buffer)))
+			// Keep the end of the buffer, which may be the beginning of the next separator
+			tail := len(s.options.Separator) - 1
+			copy(s.buffer, s.buffer[len(s.buffer)-tail:])
+			s.currentPos = tail
+			// The rest of the unit follows
+			s.synced = false
+		}
+
+		copied := copy(s.buffer[s.currentPos:], p)
+		p = p[copied:]
+
+		// A separator may straddle the previous and the new data
+		startPosSearch := s.currentPos - len(s.options.Separator)
+		if startPosSearch < 0 {
+			startPosSearch = 0
+		}
+		s.currentPos += copied
+
+		for {
+			index, length := s.find(startPosSearch)
+			if index < 0 {
+				break
+			}
+			if index == 0 {
+				// Separator of the unit being accumulated
+				s.synced = true
+				startPosSearch = length
+				continue
+			}
+
+			if !s.synced {
+				// Partial unit, e.g. when the output is joined mid-unit: it can't be decoded
+				slog.Debug("nalSplitter: Dropping data before the first separator", slog.Int("size", index))
+				s.synced = true
+			} else {
+				// Broadcast before the separator
+				unit := make([]byte, index)
+				copy(unit, s.buffer)
+				if _, err := s.writer.Write(unit); err != nil && writeErr == nil {
+					writeErr = err
+				}
+			}
+
+			// Shift
+			copy(s.buffer, s.buffer[index:s.currentPos])
+			s.currentPos -= index
+			startPosSearch = length
+		}
+	}
+
+	return written, writeErr
+}
+
+// flush writes the unit being accumulated, at the end of the stream
+func (s *nalSplitter) flush() error {
+	if s.currentPos == 0 || !s.synced {
+		s.currentPos = 0
+		return nil
+	}
+	unit := make([]byte, s.currentPos)
+	copy(unit, s.buffer)
+	s.currentPos = 0
+	_, err := s.writer.Write(unit)
+	return err
+}
+
+// find returns the position and length of the first separator in the buffer from a position, or -1 if there is none
+func (s *nalSplitter) find(from int) (int, int) {
+	b := s.buffer[:s.currentPos]
+	separator := s.options.Separator
+	if s.options.MatchShortSeparator {
+		separator = shortNALSeparator
+	}
+
+	index := bytes.Index(b[from:], separator)
+	if index < 0 {
+		return -1, 0
+	}
+	index += from
+	if s.options.MatchShortSeparator && index > 0 && b[index-1] == 0 {
+		// 4-byte start code
+		return index - 1, len(separator) + 1
+	}
+	return index, len(separator)
+}
@@ -0,0 +1,71 @@
+package stream
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+// unitRecorder records the units written to it
+type unitRecorder struct {
+	units [][]byte
+}
+
+func (r *unitRecorder) Write(p []byte) (int, error) {
+	r.units = append(r.units, bytes.Clone(p))
+	return len(p), nil
+}
+
+func TestSplitterStartingMidUnit(t *testing.T) {
+	sps := []byte{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1e}
+	pps := []byte{0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80}
+	idr := []byte{0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00}
+	shortSlice := []byte{0, 0, 1, 0x41, 0x9a, 0x02, 0x03}
+	// The end of a slice, as when the output is joined mid-unit
+	partial := []byte{0x9a, 0x02, 0x03, 0xff}
+
+	for _, tt := range []struct {
+		name    string
+		options SplitterOptions
+		stream  [][]byte
+		want    [][]byte
+	}{
+		{"synchronized", H264Splitter, [][]byte{sps, pps, idr}, [][]byte{sps, pps, idr}},
+		{"mid-unit", H264Splitter, [][]byte{partial, sps, pps, idr}, [][]byte{sps, pps, idr}},
+		{"partial unit only", H264Splitter, [][]byte{partial}, nil},
+		{"short separator mid-unit", SplitterOptions{MatchShortSeparator: true}, [][]byte{partial, shortSlice, sps, idr}, [][]byte{shortSlice, sps, idr}},
+		{"short separator synchronized", SplitterOptions{MatchShortSeparator: true}, [][]byte{sps, shortSlice, idr}, [][]byte{sps, shortSlice, idr}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Join(tt.stream, nil)
+			// The partial unit or a separator may straddle two reads
+			for split := 0; split <= len(data); split++ {
+				recorder := &unitRecorder{}
+				s := newNALSplitter(tt.options, recorder, 1024)
+				s.Write(data[:split])
+				s.Write(data[split:])
+				s.flush()
+				if !slices.EqualFunc(recorder.units, tt.want, bytes.Equal) {
+					t.Errorf("split at %d: units\n%x\nwant\n%x", split, recorder.units, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitterResynchronizesAfterOversizedUnit(t *testing.T) {
+	sps := []byte{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1e}
+	oversized := append([]byte{0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0x88}, 40)...)
+	idr := []byte{0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00}
+
+	recorder := &unitRecorder{}
+	s := newNALSplitter(H264Splitter, recorder, 16)
+	for _, unit := range [][]byte{sps, oversized, idr} {
+		s.Write(unit)
+	}
+	s.flush()
+	// The rest of the oversized unit is dropped as well
+	if want := [][]byte{sps, idr}; !slices.EqualFunc(recorder.units, want, bytes.Equal) {
+		t.Errorf("units\n%x\nwant\n%x", recorder.units, want)
+	}
+}
@@ -0,0 +1,232 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var errSPSTruncated = errors.New("truncated SPS")
+
+// SPS holds the fields of a sequence parameter set describing the picture
+type SPS struct {
+	ProfileIDC uint8
+	LevelIDC   uint8
+	Width      int // Width of the decoded pictures, after cropping
+	Height     int // Height of the decoded pictures, after cropping
+
+	// Fps is the frame rate from the VUI timing information, 0 if the SPS doesn't have it
+	Fps float64
+}
+
+// ParseSPS parses an SPS NAL unit prefixed by its start code
+func ParseSPS(nal []byte) (SPS, error) {
+	var sps SPS
+	if NALType(nal) != NALTypeSPS {
+		return sps, errors.New("not an SPS")
+	}
+	header := len(shortNALSeparator)
+	if bytes.HasPrefix(nal, nalSeparator) {
+		header = len(nalSeparator)
+	}
+	r := &bitReader{data: unescapeRBSP(nal[header+1:])}
+
+	sps.ProfileIDC = uint8(r.bits(8))
+	r.bits(8) // Constraint flags
+	sps.LevelIDC = uint8(r.bits(8))
+	r.ue() // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	separateColourPlane := false
+	switch sps.ProfileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			separateColourPlane = r.bit()
+		}
+		r.ue()       // bit_depth_luma_minus8
+		r.ue()       // bit_depth_chroma_minus8
+		r.bit()      // qpprime_y_zero_transform_bypass_flag
+		if r.bit() { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					r.skipScalingList(size)
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se() // offset_for_ref_frame
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := int(r.ue()) + 1
+	heightInMapUnits := int(r.ue()) + 1
+	frameMbsOnly := r.bit()
+	if !frameMbsOnly {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.bit() { // frame_cropping_flag
+		cropLeft, cropRight, cropTop, cropBottom = int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+	}
+	if r.err != nil {
+		return sps, r.err
+	}
+
+	fieldFactor := 2
+	if frameMbsOnly {
+		fieldFactor = 1
+	}
+	cropUnitX, cropUnitY := 1, fieldFactor
+	if chromaFormat != 0 && !separateColourPlane {
+		subWidth, subHeight := 2, 2 // 4:2:0
+		switch chromaFormat {
+		case 2: // 4:2:2
+			subHeight = 1
+		case 3: // 4:4:4
+			subWidth, subHeight = 1, 1
+		}
+		cropUnitX, cropUnitY = subWidth, subHeight*fieldFactor
+	}
+	sps.Width = widthInMbs*16 - cropUnitX*(cropLeft+cropRight)
+	sps.Height = fieldFactor*heightInMapUnits*16 - cropUnitY*(cropTop+cropBottom)
+	if sps.Width <= 0 || sps.Height <= 0 {
+		return sps, fmt.Errorf("invalid SPS picture size %dx%d", sps.Width, sps.Height)
+	}
+	if r.bit() { // vui_parameters_present_flag
+		// The picture size is valid even if the VUI is truncated
+		sps.Fps = r.vuiFps()
+	}
+	return sps, nil
+}
+
+// vuiFps reads the VUI parameters up to the timing information, and returns the frame rate, or 0 if it is absent
+func (r *bitReader) vuiFps() float64 {
+	if r.bit() { // aspect_ratio_info_present_flag
+		if r.bits(8) == 255 { // aspect_ratio_idc: Extended_SAR
+			r.bits(16) // sar_width
+			r.bits(16) // sar_height
+		}
+	}
+	if r.bit() { // overscan_info_present_flag
+		r.bit() // overscan_appropriate_flag
+	}
+	if r.bit() { // video_signal_type_present_flag
+		r.bits(3)    // video_format
+		r.bit()      // video_full_range_flag
+		if r.bit() { // colour_description_present_flag
+			r.bits(24) // colour_primaries, transfer_characteristics, matrix_coefficients
+		}
+	}
+	if r.bit() { // chroma_loc_info_present_flag
+		r.ue() // chroma_sample_loc_type_top_field
+		r.ue() // chroma_sample_loc_type_bottom_field
+	}
+	if !r.bit() { // timing_info_present_flag
+		return 0
+	}
+	unitsInTick := r.bits(32)
+	timeScale := r.bits(32)
+	if r.err != nil || unitsInTick == 0 {
+		return 0
+	}
+	// A frame lasts two ticks: one per field
+	return float64(timeScale) / float64(2*unitsInTick)
+}
+
+// unescapeRBSP removes the emulation prevention bytes (0x03 following 0x0000)
+func unescapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// bitReader reads the bits and Exp-Golomb codes of an RBSP. Reading past the end sets err.
+type bitReader struct {
+	data []byte
+	pos  int // In bits
+	err  error
+}
+
+func (r *bitReader) bit() bool {
+	return r.bits(1) == 1
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = errSPSTruncated
+			return 0
+		}
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for !r.bit() {
+		if r.err != nil || zeros >= 31 {
+			r.err = errSPSTruncated
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+func (r *bitReader) skipScalingList(size int) {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
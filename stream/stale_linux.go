@@ -0,0 +1,111 @@
+//go:build linux
+
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const staleCameraTermTimeout = 2 * time.Second
+
+// cameraProcessNames are the names of the processes which may hold the camera
+var cameraProcessNames = []string{
+	"raspivid", "raspistill",
+	"libcamera-vid", "libcamera-still",
+	"rpicam-vid", "rpicam-still",
+}
+
+// StaleCameraProcesses returns the PIDs of the camera processes which are not children of the current process,
+// e.g. left running by a crashed instance. It requires the /proc filesystem.
+func StaleCameraProcesses() ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("listing processes: %w", err)
+	}
+
+	self := os.Getpid()
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		if err != nil || !slices.Contains(cameraProcessNames, strings.TrimSpace(string(comm))) {
+			continue
+		}
+		if parentPID(pid) == self {
+			// Camera started by this instance
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// ReleaseStaleCamera terminates the camera processes which are not children of the current process,
+// so that the camera can be acquired after a crash. Call it before starting the streamer.
+// Processes are asked to terminate, then killed if they are still running after 2 seconds.
+// Only processes with a known camera command name are affected.
+func ReleaseStaleCamera() error {
+	pids, err := StaleCameraProcesses()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, pid := range pids {
+		slog.Warn("ReleaseStaleCamera: Terminating stale camera process", slog.Int("pid", pid))
+		if err := terminate(pid); err != nil {
+			errs = append(errs, fmt.Errorf("process %d: %w", pid, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// terminate sends SIGTERM to a process, then SIGKILL if it doesn't exit in time
+func terminate(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(staleCameraTermTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid))); os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return process.Kill()
+}
+
+// parentPID returns the parent of a process, or -1 if it can't be determined
+func parentPID(pid int) int {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return -1
+	}
+	// The command name, in parentheses, may contain spaces: parse after it
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) < 2 {
+		return -1
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return -1
+	}
+	return ppid
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package stream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// StaleCameraProcesses is only supported on Linux, where the camera commands run
+func StaleCameraProcesses() ([]int, error) {
+	return nil, fmt.Errorf("stale camera processes: %w", errors.ErrUnsupported)
+}
+
+// ReleaseStaleCamera is only supported on Linux, where the camera commands run
+func ReleaseStaleCamera() error {
+	_, err := StaleCameraProcesses()
+	return err
+}
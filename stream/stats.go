@@ -0,0 +1,258 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dropRateWindow is the period over which the drop rate and the frame rate are measured
+const dropRateWindow = 10 * time.Second
+
+// Defaults of the HealthThresholds fields
+const (
+	defaultMaxFrameAge   = 5 * time.Second
+	defaultMaxDropRate   = 0.1
+	defaultRestartWindow = time.Minute
+)
+
+// Health classifies the state of the stream
+type Health string
+
+// Health states
+const (
+	HealthHealthy  Health = "healthy"  // Frames are flowing, or no client requested the stream
+	HealthDegraded Health = "degraded" // Frames are flowing, but many are dropped or the camera restarted recently
+	HealthDown     Health = "down"     // The camera failed, or produced no frame recently while clients are connected
+)
+
+// HealthThresholds defines when the stream is considered degraded or down
+type HealthThresholds struct {
+	MaxFrameAge   Duration `json:"maxFrameAge"`   // The stream is down if no frame was produced for this long. Defaults to 5 seconds.
+	MaxDropRate   float64  `json:"maxDropRate"`   // The stream is degraded above this ratio of dropped frames. Defaults to 0.1.
+	RestartWindow Duration `json:"restartWindow"` // The stream is degraded for this long after a restart. Defaults to 1 minute.
+}
+
+func (thresholds HealthThresholds) withDefaults() HealthThresholds {
+	if thresholds.MaxFrameAge == 0 {
+		thresholds.MaxFrameAge = Duration(defaultMaxFrameAge)
+	}
+	if thresholds.MaxDropRate == 0 {
+		thresholds.MaxDropRate = defaultMaxDropRate
+	}
+	if thresholds.RestartWindow == 0 {
+		thresholds.RestartWindow = Duration(defaultRestartWindow)
+	}
+	return thresholds
+}
+
+// Stats describes the activity of the stream
+type Stats struct {
+	Health        Health    `json:"health"`
+	Running       bool      `json:"running"`       // True if clients requested the stream, or it is always on
+	Frames        uint64    `json:"frames"`        // Number of frames (VCL NAL units) produced by the camera
+	DroppedFrames uint64    `json:"droppedFrames"` // Number of frames dropped by the writer
+	DropRate      float64   `json:"dropRate"`      // Ratio of dropped frames over the last complete window of 10 seconds
+	InvalidNALs   uint64    `json:"invalidNALs"`   // Number of malformed NAL units, counted if CameraOptions.ValidateNALs is set
+	Restarts      int       `json:"restarts"`      // Number of restarts after a camera failure
+	LastRestart   time.Time `json:"lastRestart"`
+	LastFrame     time.Time `json:"lastFrame"`
+}
+
+// statsWriter counts the frames written to it, and those dropped by the writer
+type statsWriter struct {
+	writer io.Writer
+	clock  Clock
+
+	mutex         sync.Mutex
+	counters      []DropCounter // Writers dropping units without failing
+	counted       uint64        // Sum of the drops of the counters at the latest frame
+	frames        uint64
+	dropped       uint64
+	lastFrame     time.Time
+	windowStart   time.Time
+	windowFrames  uint64
+	windowDropped uint64
+	dropRate      float64 // Over the last complete window
+
+	sps            []byte // Latest SPS, to parse it only when it changes
+	params         Params
+	windowPictures uint64
+
+	invalidNALs uint64
+}
+
+func (w *statsWriter) Write(nal []byte) (int, error) {
+	n, err := w.writer.Write(nal)
+	nalType := NALType(nal)
+	if nalType == NALTypeSPS {
+		w.updateSPS(nal)
+	}
+	if !isVCL(nalType) {
+		return n, err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	now := w.clock.Now()
+	if elapsed := now.Sub(w.windowStart); elapsed >= dropRateWindow {
+		if w.windowFrames > 0 {
+			w.dropRate = float64(w.windowDropped) / float64(w.windowFrames)
+		}
+		if !w.windowStart.IsZero() && elapsed < 2*dropRateWindow {
+			// Not measured after an interruption of the stream
+			w.params.Fps = float64(w.windowPictures) / elapsed.Seconds()
+		}
+		w.windowStart = now
+		w.windowFrames = 0
+		w.windowDropped = 0
+		w.windowPictures = 0
+	}
+	if firstSliceOfPicture(nal) {
+		w.windowPictures++
+	}
+	w.frames++
+	w.windowFrames++
+	w.lastFrame = now
+	if errors.Is(err, ErrFrameDropped) {
+		w.dropped++
+		w.windowDropped++
+	}
+	var counted uint64
+	for _, counter := range w.counters {
+		counted += counter.WriteDrops()
+	}
+	w.dropped += counted - w.counted
+	w.windowDropped += counted - w.counted
+	w.counted = counted
+	return n, err
+}
+
+// addDropCounter counts the drops of a writer from now on, unless they are already counted
+func (w *statsWriter) addDropCounter(counter DropCounter) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, c := range w.counters {
+		if c == counter {
+			return
+		}
+	}
+	w.counters = append(w.counters, counter)
+	w.counted += counter.WriteDrops()
+}
+
+// addInvalidNAL counts a malformed NAL unit and returns the number of them
+func (w *statsWriter) addInvalidNAL() uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.invalidNALs++
+	return w.invalidNALs
+}
+
+// updateSPS updates the parameters of the stream from a new SPS
+func (w *statsWriter) updateSPS(nal []byte) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if bytes.Equal(nal, w.sps) {
+		return
+	}
+	w.sps = bytes.Clone(nal)
+	sps, err := ParseSPS(nal)
+	if err != nil {
+		slog.Warn("statsWriter: Invalid SPS", slog.Any("error", err))
+		return
+	}
+	if sps.Width != w.params.Width || sps.Height != w.params.Height {
+		slog.Info("statsWriter: Stream resolution", slog.Int("width", sps.Width), slog.Int("height", sps.Height))
+	}
+	w.params.Width = sps.Width
+	w.params.Height = sps.Height
+	w.params.NominalFps = sps.Fps
+}
+
+// firstSliceOfPicture returns true if the slice is the first of its picture: its first_mb_in_slice is 0,
+// coded as a single 1 bit
+func firstSliceOfPicture(nal []byte) bool {
+	header := len(shortNALSeparator)
+	if bytes.HasPrefix(nal, nalSeparator) {
+		header = len(nalSeparator)
+	}
+	return len(nal) > header+1 && nal[header+1]&0x80 != 0
+}
+
+// Params are the actual parameters of the stream, which may differ from the requested ones
+// if the camera doesn't support them
+type Params struct {
+	Width  int     `json:"width"`  // From the SPS
+	Height int     `json:"height"` // From the SPS
+	Fps    float64 `json:"fps"`    // Measured over the last complete window of 10 seconds, 0 until then
+
+	// NominalFps is the frame rate announced by the VUI timing of the SPS, 0 if the encoder doesn't set it
+	NominalFps float64 `json:"nominalFps"`
+}
+
+// ActualParams returns the parameters of the stream produced by the camera.
+// It returns false until the camera produced an SPS.
+func (s *Streamer) ActualParams() (Params, bool) {
+	s.stats.mutex.Lock()
+	defer s.stats.mutex.Unlock()
+
+	return s.stats.params, s.stats.params.Width != 0
+}
+
+// Stats returns the activity of the stream and its health
+func (s *Streamer) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stats.mutex.Lock()
+	stats := Stats{
+		Running:       s.state != cameraStopped,
+		Frames:        s.stats.frames,
+		DroppedFrames: s.stats.dropped,
+		DropRate:      s.stats.dropRate,
+		InvalidNALs:   s.stats.invalidNALs,
+		Restarts:      s.restarts,
+		LastRestart:   s.lastRestart,
+		LastFrame:     s.stats.lastFrame,
+	}
+	s.stats.mutex.Unlock()
+
+	thresholds := s.options.Health.withDefaults()
+	now := s.clock.Now()
+	lastActivity := stats.LastFrame
+	if s.started.After(lastActivity) {
+		// Give the camera time to produce its first frame
+		lastActivity = s.started
+	}
+	switch {
+	case !stats.Running:
+		stats.Health = HealthHealthy
+	case s.state == cameraFailed || now.Sub(lastActivity) > time.Duration(thresholds.MaxFrameAge):
+		stats.Health = HealthDown
+	case stats.DropRate > thresholds.MaxDropRate,
+		!stats.LastRestart.IsZero() && now.Sub(stats.LastRestart) < time.Duration(thresholds.RestartWindow):
+		stats.Health = HealthDegraded
+	default:
+		stats.Health = HealthHealthy
+	}
+	return stats
+}
+
+// StatsHandler returns the stream stats as JSON. The status is 503 Service Unavailable if the stream is down.
+func (s *Streamer) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := s.Stats()
+	status := http.StatusOK
+	if stats.Health == HealthDown {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, stats)
+}
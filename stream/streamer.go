@@ -0,0 +1,279 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// minReconfigureInterval prevents restart storms caused by successive option changes
+const minReconfigureInterval = 2 * time.Second
+
+var (
+	// ErrCameraNotRunning is returned by control operations when the camera is stopped
+	ErrCameraNotRunning = errors.New("camera is not running")
+	// ErrReconfiguredRecently is returned when options are changed again too soon after a change
+	ErrReconfiguredRecently = errors.New("options changed too recently")
+)
+
+// Streamer runs the camera while clients are connected, or always if requested, and writes its H264 stream to a writer
+type Streamer struct {
+	options CameraOptions
+	writer  io.Writer
+
+	mutex         sync.Mutex         // Serializes the transitions of the camera state
+	cameraStarted sync.Mutex         // Held while a camera process is running
+	state         cameraState        // Lifecycle state of the camera
+	stopCamera    context.CancelFunc // Stops the running camera, nil unless running
+	clock         Clock
+	reconfigured  time.Time // Time of the last options change
+
+	stats       *statsWriter
+	started     time.Time // Time the camera was last started
+	restarts    int
+	lastRestart time.Time
+	connections int // Number of connections, as last notified to Run
+
+	profiles Profiles
+	profile  string // Name of the profile of the current options, "" if set otherwise
+
+	keyframes *KeyframeCache   // Latest keyframe of the stream, for snapshots
+	snapshots *snapshotLimiter // Limits the concurrent snapshot decodes
+
+	alwaysOn bool // Keeps the camera running without connections, e.g. for recording
+	active   bool // Set while Run is running: the camera can only run then
+}
+
+// NewStreamer creates a streamer writing the video of the camera to writer
+func NewStreamer(options CameraOptions, writer io.Writer) *Streamer {
+	s := &Streamer{
+		options: options,
+		writer:  writer,
+		clock:   SystemClock,
+		state:   cameraStopped,
+	}
+	s.snapshots = newSnapshotLimiter(defaultMaxSnapshots, defaultSnapshotWait, SystemClock)
+	s.keyframes = NewKeyframeCache(snapshotCacheSizeKB * 1024)
+	// The cache goes first: it never fails, so the writer always gets the units
+	s.stats = &statsWriter{writer: io.MultiWriter(s.keyframes, writer), clock: s.clock}
+	if counter, ok := writer.(DropCounter); ok {
+		s.stats.addDropCounter(counter)
+	}
+	return s
+}
+
+// Video streams the video for the Raspberry Pi camera to a websocket.
+// It returns once connectionsChange is closed and the camera process is terminated.
+func Video(options CameraOptions, writer io.Writer, connectionsChange chan int) {
+	NewStreamer(options, writer).Run(connectionsChange)
+}
+
+// Run starts the camera on the first connection and stops it when there are no more connections,
+// unless it is always on (see SetAlwaysOn), until connectionsChange is closed.
+// It then stops the camera and waits for its process to terminate.
+func (s *Streamer) Run(connectionsChange chan int) {
+	if s.writer == nil {
+		slog.Error("Streamer: No writer to stream the video to")
+		return
+	}
+	if connectionsChange == nil {
+		slog.Error("Streamer: No channel of connection changes")
+		return
+	}
+	if err := s.Options().Validate(); err != nil {
+		slog.Error("Streamer: Invalid camera options", slog.Any("error", err))
+		return
+	}
+	defer s.shutdown()
+
+	s.mutex.Lock()
+	s.active = true
+	if s.alwaysOn {
+		s.startLocked()
+	}
+	s.mutex.Unlock()
+
+	for n := range connectionsChange {
+		s.mutex.Lock()
+		s.connections = n
+		s.applyDemandLocked()
+		s.mutex.Unlock()
+	}
+}
+
+// SetAlwaysOn keeps the camera running regardless of the number of connections, e.g. while the stream is recorded
+// by another sink of the writer, so that continuous recording coexists with on-demand streaming.
+// When it is unset, the camera stops if there are no connections. It can be called before or while Run is running.
+func (s *Streamer) SetAlwaysOn(on bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.alwaysOn = on
+	if s.active {
+		s.applyDemandLocked()
+	}
+}
+
+// applyDemandLocked starts the camera while there are connections or it is always on, and stops it otherwise
+func (s *Streamer) applyDemandLocked() {
+	if s.connections > 0 || s.alwaysOn {
+		s.startLocked()
+		return
+	}
+	// Don't snapshot an outdated picture
+	s.keyframes.Reset()
+	s.stopLocked()
+}
+
+// RequestKeyframe makes the encoder emit a keyframe.
+// Neither raspivid nor libcamera-vid can be signaled to do so, so the camera is restarted:
+// a new stream always begins with SPS/PPS and a keyframe. Clients freeze until the camera is up again.
+func (s *Streamer) RequestKeyframe() error {
+	return s.RestartCamera()
+}
+
+// RestartCamera stops the camera process and starts a new one with the same options,
+// e.g. to apply a tuning changed outside of the streamer. Connections are kept: the new stream
+// begins with SPS/PPS and a keyframe, from which clients resume. It is serialized with the other
+// control operations, and waits neither for the old process to terminate nor for the new one to start.
+func (s *Streamer) RestartCamera() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.restartLocked(); err != nil {
+		return err
+	}
+	slog.Info("Streamer: Restarted camera")
+	return nil
+}
+
+// SetClock replaces the time source of the timeouts, delays and statistics of the streamer,
+// e.g. by a ManualClock in tests. It must be called before Run.
+func (s *Streamer) SetClock(clock Clock) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.clock = clock
+	s.stats.clock = clock
+	s.snapshots.clock = clock
+}
+
+// AddDropCounter counts the units dropped by a writer in the statistics, e.g. when it is combined with others
+// by io.MultiWriter. A writer implementing DropCounter given to NewStreamer is counted once.
+func (s *Streamer) AddDropCounter(counter DropCounter) {
+	s.stats.addDropCounter(counter)
+}
+
+// Options returns the current camera options
+func (s *Streamer) Options() CameraOptions {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.options
+}
+
+// Reconfigure validates and applies new camera options. If the camera is running, it is restarted
+// and clients receive the parameter sets of the new stream. It returns true if the camera was restarted.
+// Changes less than 2 seconds apart are rejected with ErrReconfiguredRecently.
+func (s *Streamer) Reconfigure(options CameraOptions) (bool, error) {
+	return s.reconfigure(options, "")
+}
+
+// reconfigure applies new options, set by the named profile if not empty
+func (s *Streamer) reconfigure(options CameraOptions, profile string) (bool, error) {
+	if err := options.Validate(); err != nil {
+		return false, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	if !s.reconfigured.IsZero() && now.Sub(s.reconfigured) < minReconfigureInterval {
+		return false, ErrReconfiguredRecently
+	}
+	s.options = options
+	s.profile = profile
+	s.reconfigured = now
+
+	return s.restartLocked() == nil, nil
+}
+
+// runCamera runs the camera and restarts it according to the restart policy if it fails
+func (s *Streamer) runCamera(ctx context.Context, options CameraOptions) {
+	policy := options.RestartPolicy.withDefaults()
+	attempt := 0
+	var writer io.Writer = s.stats
+	if options.ValidateNALs {
+		writer = nalValidator{stats: s.stats}
+	}
+
+	for {
+		started := s.clock.Now()
+		err := startCamera(ctx, options, writer, &s.cameraStarted, s.clock)
+		if ctx.Err() != nil {
+			// Stop requested
+			return
+		}
+		if s.clock.Now().Sub(started) > time.Duration(policy.MaxDelay) {
+			// Ran long enough to be considered healthy
+			attempt = 0
+		}
+
+		if err != nil {
+			options.OnEvent.Emit(s.clock, Event{Type: EventCameraError, Error: err})
+		}
+		if err == nil || errors.Is(err, errInvalidOptions) || (policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts) {
+			if err != nil {
+				slog.Error("Streamer: Camera failed", slog.Any("error", err), slog.Int("restarts", attempt))
+			}
+			s.terminated(ctx, err != nil)
+			return
+		}
+
+		delay := policy.delay(attempt)
+		attempt++
+		s.restarted()
+		slog.Error("Streamer: Camera failed; restarting", slog.Any("error", err), slog.Int("attempt", attempt), slog.Duration("delay", delay))
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(delay):
+		}
+	}
+}
+
+// terminated applies the termination of a camera which ended by itself, unless it was stopped in the meantime
+func (s *Streamer) terminated(ctx context.Context, failed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.terminatedLocked(ctx, failed)
+}
+
+// restarted records a restart after a failure
+func (s *Streamer) restarted() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.restarts++
+	s.lastRestart = s.clock.Now()
+	s.started = s.lastRestart
+}
+
+// shutdown stops the camera and waits for its process to terminate
+func (s *Streamer) shutdown() {
+	s.mutex.Lock()
+	s.active = false
+	s.keyframes.Reset()
+	s.stopLocked()
+	s.mutex.Unlock()
+	// The camera holds cameraStarted until its process is terminated.
+	// A camera start which was pending gives up once it gets it, as it was stopped.
+	s.cameraStarted.Lock()
+	s.cameraStarted.Unlock()
+	slog.Debug("Streamer: Shut down")
+}
@@ -0,0 +1,227 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runStreamer runs the streamer until the test ends, and returns the channel of its connection changes
+func runStreamer(t *testing.T, s *Streamer) chan int {
+	t.Helper()
+	connections := make(chan int)
+	done := make(chan struct{})
+	go func() {
+		s.Run(connections)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(connections)
+		<-done
+	})
+	return connections
+}
+
+func TestRestartBackoff(t *testing.T) {
+	source := &fakeSource{err: errors.New("no camera")}
+	clock := NewManualClock(testEpoch)
+	s := NewStreamer(CameraOptions{Source: source, RestartPolicy: RestartPolicy{InitialDelay: Duration(time.Second)}}, io.Discard)
+	s.SetClock(clock)
+	connections := runStreamer(t, s)
+
+	connections <- 1
+	for attempt, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		// The streamer waits for the restart delay once the attempt failed
+		clock.WaitForTimers(1)
+		if opens := int(source.opens.Load()); opens != attempt+1 {
+			t.Fatalf("%d opens before restart %d, want %d", opens, attempt+1, attempt+1)
+		}
+		clock.Advance(delay - time.Millisecond)
+		if opens := int(source.opens.Load()); opens != attempt+1 {
+			t.Fatalf("restarted %d times before the %v delay", opens-1, delay)
+		}
+		clock.Advance(time.Millisecond)
+	}
+	clock.WaitForTimers(1)
+	if opens := source.opens.Load(); opens != 4 {
+		t.Errorf("%d opens, want 4", opens)
+	}
+	// Each failure schedules a restart
+	if restarts := s.Stats().Restarts; restarts != 4 {
+		t.Errorf("Stats().Restarts = %d, want 4", restarts)
+	}
+}
+
+func TestBusyCameraRetries(t *testing.T) {
+	source := &fakeSource{closeErr: errCameraBusy}
+	clock := NewManualClock(testEpoch)
+	options := CameraOptions{
+		Source:          source,
+		StartRetries:    2,
+		StartRetryDelay: Duration(time.Second),
+		// Out of the way of the start retries
+		RestartPolicy: RestartPolicy{InitialDelay: Duration(time.Hour)},
+	}
+	s := NewStreamer(options, io.Discard)
+	s.SetClock(clock)
+	connections := runStreamer(t, s)
+
+	connections <- 1
+	for opens := int32(1); opens <= 3; opens++ {
+		clock.WaitForTimers(1)
+		if n := source.opens.Load(); n != opens {
+			t.Fatalf("%d opens, want %d", n, opens)
+		}
+		clock.Advance(time.Second)
+	}
+	// Out of start retries: the restart policy waits for its own delay
+	clock.WaitForTimers(1)
+	if n := source.opens.Load(); n != 3 {
+		t.Errorf("%d opens after the start retries, want 3", n)
+	}
+}
+
+// testStream is the H264 stream of a keyframe followed by a slice
+var testStream = bytes.Join([][]byte{
+	{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1e},
+	{0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80},
+	{0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00},
+	{0, 0, 0, 1, 0x41, 0x9a, 0x02, 0x03},
+}, nil)
+
+func TestVideoLifecycleDoesNotLeakGoroutines(t *testing.T) {
+	source := &fakeSource{stream: testStream}
+	baseline := runtime.NumGoroutine()
+
+	connections := make(chan int)
+	done := make(chan struct{})
+	go func() {
+		Video(CameraOptions{Source: source}, io.Discard, connections)
+		close(done)
+	}()
+	const cycles = 200
+	for i := 0; i < cycles; i++ {
+		connections <- 1
+		connections <- 0
+	}
+	close(connections)
+	<-done
+
+	if opens := source.opens.Load(); opens == 0 || opens > cycles {
+		t.Errorf("camera opened %d times over %d cycles", opens, cycles)
+	}
+	if readers := source.readers.Load(); readers != 0 {
+		t.Errorf("%d camera outputs not closed", readers)
+	}
+	// The goroutines of the last cycle may still be exiting
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%d goroutines after %d cycles, %d before:\n%s", n, cycles, baseline, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestRunRejectsNilInputs(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		writer      io.Writer
+		connections chan int
+		want        string
+	}{
+		{"nil writer", nil, make(chan int), "Streamer: No writer to stream the video to"},
+		{"nil channel", io.Discard, nil, "Streamer: No channel of connection changes"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			source := &fakeSource{stream: testStream}
+			done := make(chan struct{})
+			go func() {
+				// Always on: the camera would start right away if Run didn't return
+				s := NewStreamer(CameraOptions{Source: source}, tt.writer)
+				s.SetAlwaysOn(true)
+				s.Run(tt.connections)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run didn't return")
+			}
+			if opens := source.opens.Load(); opens != 0 {
+				t.Errorf("camera opened %d times", opens)
+			}
+			if !strings.Contains(logs.String(), tt.want) {
+				t.Errorf("logs %q, want %q", logs.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestVideoStopsCameraWhenChannelCloses(t *testing.T) {
+	source := &fakeSource{stream: testStream}
+	connections := make(chan int)
+	done := make(chan struct{})
+	go func() {
+		Video(CameraOptions{Source: source}, io.Discard, connections)
+		close(done)
+	}()
+
+	connections <- 1
+	deadline := time.Now().Add(5 * time.Second)
+	for source.readers.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("camera not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Closed while a client is still connected
+	close(connections)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Video didn't return")
+	}
+	if readers := source.readers.Load(); readers != 0 {
+		t.Errorf("Video returned with %d camera outputs open", readers)
+	}
+}
+
+// droppingWriter drops every other unit, without failing
+type droppingWriter struct {
+	writes, drops uint64
+}
+
+func (w *droppingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes%2 == 0 {
+		w.drops++
+	}
+	return len(p), nil
+}
+
+func (w *droppingWriter) WriteDrops() uint64 {
+	return w.drops
+}
+
+func TestDropCounterCounted(t *testing.T) {
+	writer := &droppingWriter{}
+	s := NewStreamer(CameraOptions{}, writer)
+	// Already counted by NewStreamer
+	s.AddDropCounter(writer)
+	slice := []byte{0, 0, 0, 1, 0x65, 0x88, 0x84}
+	for i := 0; i < 4; i++ {
+		if _, err := s.stats.Write(slice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := s.Stats(); stats.Frames != 4 || stats.DroppedFrames != 2 {
+		t.Errorf("%d frames and %d dropped, want 4 and 2", stats.Frames, stats.DroppedFrames)
+	}
+}
@@ -1,62 +1,333 @@
 package stream
 
 import (
-	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 )
 
 const (
-	readBufferSize = 4096
+	readBufferSize = 64 * 1024 // Default size of the reads of the camera output: the default capacity of a Linux pipe
 	bufferSizeKB   = 256
+	maxReadErrors  = 5 // Consecutive read errors before the camera is considered dead
+	stderrTailSize = 4096
 
-	legacyCommand    = "raspivid"
-	libcameraCommand = "libcamera-vid"
+	defaultStartRetryDelay = time.Second
 )
 
-var nalSeparator = []byte{0, 0, 0, 1} //NAL break
+// Codec is the encoder producing the H264 stream
+type Codec string
+
+// Supported codecs
+const (
+	CodecH264  Codec = "h264"  // Hardware H264 encoder (default)
+	CodecLibav Codec = "libav" // libav software encoder, libcamera only
+
+	codecYUV420 Codec = "yuv420" // Uncompressed frames, used by RawFrames
+)
 
 // CameraOptions sets the options to send to raspivid
 type CameraOptions struct {
-	Width               int
-	Height              int
-	Fps                 int
-	HorizontalFlip      bool
-	VerticalFlip        bool
-	Rotation            int
-	UseLibcamera        bool // Set to true to enable libcamera, otherwise use legacy raspivid stack
-	AutoDetectLibCamera bool // Set to true to automatically detect if libcamera is available. If true, UseLibcamera is ignored.
+	Width               int    `json:"width"`
+	Height              int    `json:"height"`
+	Fps                 int    `json:"fps"`
+	HorizontalFlip      bool   `json:"horizontalFlip"`
+	VerticalFlip        bool   `json:"verticalFlip"`
+	Rotation            int    `json:"rotation"`
+	UseLibcamera        bool   `json:"useLibcamera"`        // Set to true to enable libcamera, otherwise use legacy raspivid stack
+	AutoDetectLibCamera bool   `json:"autoDetectLibCamera"` // Set to true to automatically detect if libcamera is available, preferring rpicam-vid. If true, UseLibcamera is ignored.
+	Preview             bool   `json:"preview"`             // Set to true to show a preview window on the local display, otherwise run headless
+	PreviewX            int    `json:"previewX"`            // Preview window position and size. Only used if Preview is set and PreviewWidth/PreviewHeight are not 0.
+	PreviewY            int    `json:"previewY"`
+	PreviewWidth        int    `json:"previewWidth"`
+	PreviewHeight       int    `json:"previewHeight"`
+	TuningFile          string `json:"tuningFile"`  // Sensor tuning file, e.g. for NoIR cameras. libcamera only.
+	IntraPeriod         int    `json:"intraPeriod"` // Number of frames between keyframes (GOP size). 0 keeps the encoder default.
+
+	// Bitrate is the target bitrate of the encoder, in bits per second. 0 keeps the encoder default.
+	Bitrate int `json:"bitrate"`
+	// NALBufferSize is the size of the buffer holding a NAL unit while it is read; bigger units are dropped.
+	// Defaults to RecommendedNALBufferSize, derived from the resolution, bitrate and intra period.
+	NALBufferSize int `json:"nalBufferSize"`
+
+	// ForceBackend, if set, selects the camera command regardless of UseLibcamera and AutoDetectLibCamera.
+	// Starting the camera fails if the command isn't installed.
+	ForceBackend Backend `json:"forceBackend"`
+
+	// Codec selects the encoder. The libav encoder supports B-frames and other encoder parameters,
+	// but is much slower than the hardware one, and its output isn't constrained to the baseline profile
+	// decoded by the web client.
+	Codec Codec `json:"codec"`
+	// LibavCodecOptions are passed to the libav encoder, e.g. "bf=2;refs=3;g=60". Only used with CodecLibav.
+	// B-frames are sent out of display order and delay the stream by the reordering depth:
+	// the clients' decoder must support reordering, and latency increases.
+	LibavCodecOptions string `json:"libavCodecOptions"`
+	// LowLatency tunes the libav encoder and muxer for latency (no B-frames, no lookahead, immediate packet flush).
+	// Only honored by libcamera with CodecLibav: the hardware encoder output is already flushed immediately.
+	LowLatency bool `json:"lowLatency"`
+
+	// ConfigureCommand, if set, is called with the camera command before it is started.
+	// It can be used to set the environment, SysProcAttr or resource limits.
+	// The command's stdout is read by the streamer: overriding cmd.Stdout breaks streaming.
+	ConfigureCommand func(cmd *exec.Cmd) `json:"-"`
+
+	// Nice sets the scheduling priority of the camera process, from -20 (highest) to 19 (lowest). 0 keeps the default.
+	// Negative values require privileges. IONice sets the I/O scheduling class (IONiceRealtime, IONiceBestEffort or IONiceIdle)
+	// and IONiceLevel the priority within the class, from 0 (highest) to 7. Implemented with the nice and ionice commands: Linux only.
+	Nice        int `json:"nice"`
+	IONice      int `json:"ioNice"`
+	IONiceLevel int `json:"ioNiceLevel"`
+
+	StartRetries    int      `json:"startRetries"`    // Number of times to retry starting the camera if it is busy, e.g. still held after an unclean shutdown
+	StartRetryDelay Duration `json:"startRetryDelay"` // Delay between retries. Defaults to 1 second.
+
+	// RestartPolicy defines how the camera is restarted when it fails while clients are connected
+	RestartPolicy RestartPolicy `json:"restartPolicy"`
+
+	// NALFilter, if set, is applied to every NAL unit before it is broadcast
+	NALFilter NALFilter `json:"-"`
+
+	// Source, if set, replaces the camera as the producer of the H264 stream
+	Source Source `json:"-"`
+
+	// PipelineCommand, if set, replaces the camera command by a user-defined command writing an H264 Annex B stream
+	// to its standard output, e.g. a GStreamer pipeline: gst-launch-1.0 -q libcamerasrc ! ... ! h264parse ! fdsink.
+	// The first element is the program and the others its arguments. The options passed to the camera command
+	// (size, fps, flips, codec...) are not applied to it; ConfigureCommand and the process priority are.
+	PipelineCommand []string `json:"pipelineCommand"`
+
+	// Splitter defines how the camera output is cut into NAL units. The zero value splits H264 streams.
+	Splitter SplitterOptions `json:"-"`
+
+	// Health defines the thresholds of the health reported by Streamer.Stats
+	Health HealthThresholds `json:"health"`
+
+	// OnEvent, if set, receives the camera lifecycle events
+	OnEvent EventListener `json:"-"`
+
+	// ReadBufferSize is the maximum size of each read of the camera output. Defaults to 64 KB.
+	// Bigger reads take fewer syscalls at high bitrates; reads return as soon as data is available, so latency is unaffected.
+	ReadBufferSize int `json:"readBufferSize"`
+
+	// NALStatsInterval, if set, logs a breakdown of the NAL unit types produced by the camera at this interval.
+	// Useful to diagnose a stream which looks frozen, e.g. when the encoder stops emitting keyframes.
+	NALStatsInterval Duration `json:"nalStatsInterval"`
+
+	// ValidateNALs checks the header of each NAL unit written by the streamer, and logs and counts
+	// the malformed ones in Stats.InvalidNALs, to catch framing bugs or camera glitches early.
+	// Off by default, as it costs a little CPU.
+	ValidateNALs bool `json:"validateNALs"`
+
+	// Fallbacks are alternative configurations, e.g. another backend or a lower resolution, tried in order
+	// when the camera fails before producing any output, as on devices where the preferred stack is flaky.
+	// Each attempt is fully stopped before the next one. The fallbacks use the event listener of these options,
+	// and the streamer applies the restart policy and health thresholds of these options to the whole sequence.
+	Fallbacks []CameraOptions `json:"fallbacks"`
+
+	// FrozenTimeout, if set, restarts the camera through the restart policy when its consecutive keyframes have shown
+	// the same picture for this long, as when the sensor is stuck while the encoder keeps producing a stream.
+	// The intra period must be much shorter than the timeout. It is ignored when Source is set, as a recording,
+	// e.g. a looping FileSource, legitimately repeats its keyframes.
+	// The built-in comparison considers two keyframes identical when their sizes differ by at most FrozenSizeTolerance
+	// times the size of the previous one, 0.001 by default: a frozen sensor only changes a few bytes of the slice headers,
+	// while the noise of a live static scene changes much more. Raise it if a stuck sensor goes undetected, lower it
+	// if a very static scene, e.g. in the dark, is restarted. SameKeyframes, if set, replaces the built-in comparison.
+	FrozenTimeout       Duration           `json:"frozenTimeout"`
+	FrozenSizeTolerance float64            `json:"frozenSizeTolerance"`
+	SameKeyframes       KeyframeComparator `json:"-"`
+
+	// QueueSize, if set, queues up to this number of NAL units between the camera and the writer of the streamer,
+	// so that bursts or a momentarily slow writer don't stall the reading of the camera. When the queue is full,
+	// the oldest slice which isn't part of a keyframe is dropped, and so are the slices depending on it, up to the next keyframe.
+	// When it only holds keyframes, the oldest keyframe is dropped: it never holds more than QueueSize units.
+	QueueSize int `json:"queueSize"`
 }
 
-// Video streams the video for the Raspberry Pi camera to a websocket
-func Video(options CameraOptions, writer io.Writer, connectionsChange chan int) {
-	stopChan := make(chan struct{})
-	defer close(stopChan)
-	cameraStarted := sync.Mutex{}
-	firstConnection := true
-
-	for n := range connectionsChange {
-		if n == 0 {
-			// No more connections, stop the camera
-			firstConnection = true
-			stopChan <- struct{}{}
-		} else if firstConnection {
-			// First connection, start the camera
-			firstConnection = false
-			go startCamera(options, writer, stopChan, &cameraStarted)
+// Validate checks that the options can be passed to the camera command.
+// It checks every field and returns all the problems found, joined with errors.Join.
+func (options CameraOptions) Validate() error {
+	var errs []error
+	check := func(ok bool, message string) {
+		if !ok {
+			errs = append(errs, errors.New(message))
 		}
 	}
+
+	check(options.Width >= 0 && options.Height >= 0, "width and height must not be negative")
+	check(options.Fps >= 0, "fps must not be negative")
+	if !slices.Contains([]int{0, 90, 180, 270}, options.Rotation) {
+		errs = append(errs, fmt.Errorf("rotation must be 0, 90, 180 or 270, not %d", options.Rotation))
+	}
+	if options.Preview {
+		check(options.PreviewX >= 0 && options.PreviewY >= 0 && options.PreviewWidth >= 0 && options.PreviewHeight >= 0,
+			"preview geometry must not be negative")
+		check((options.PreviewWidth == 0) == (options.PreviewHeight == 0), "preview width and height must be set together")
+	}
+	if options.ForceBackend != "" && !options.ForceBackend.valid() {
+		errs = append(errs, fmt.Errorf("unknown backend %q", options.ForceBackend))
+	}
+	if options.TuningFile != "" {
+		if _, err := os.Stat(options.TuningFile); err != nil {
+			errs = append(errs, fmt.Errorf("tuning file: %w", err))
+		}
+	}
+	check(options.IntraPeriod >= 0, "intra period must not be negative")
+	check(options.Bitrate >= 0, "bitrate must not be negative")
+	check(options.NALBufferSize >= 0, "NAL buffer size must not be negative")
+	switch options.Codec {
+	case "", CodecH264:
+		check(options.LibavCodecOptions == "", "libav codec options require the libav codec")
+		check(!options.LowLatency, "low latency tuning requires the libav codec")
+	case CodecLibav:
+	default:
+		errs = append(errs, fmt.Errorf("unknown codec %q", options.Codec))
+	}
+	errs = append(errs, options.validatePriority())
+	check(options.StartRetries >= 0 && options.StartRetryDelay >= 0, "start retries and delay must not be negative")
+	errs = append(errs, options.RestartPolicy.validate())
+	check(options.Health.MaxFrameAge >= 0 && options.Health.MaxDropRate >= 0 && options.Health.RestartWindow >= 0,
+		"health thresholds must not be negative")
+	check(options.ReadBufferSize >= 0, "read buffer size must not be negative")
+	check(options.NALStatsInterval >= 0, "NAL stats interval must not be negative")
+	check(options.FrozenTimeout >= 0, "frozen timeout must not be negative")
+	check(options.FrozenSizeTolerance >= 0 && options.FrozenSizeTolerance < 1, "frozen size tolerance must be between 0 and 1")
+	check(options.QueueSize >= 0, "queue size must not be negative")
+	if options.PipelineCommand != nil {
+		check(len(options.PipelineCommand) > 0 && options.PipelineCommand[0] != "", "pipeline command must name a program")
+		check(options.Source == nil, "pipeline command and source are exclusive")
+	}
+	for i, fallback := range options.Fallbacks {
+		if err := fallback.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("fallback %d: %w", i+1, err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
-func startCamera(options CameraOptions, writer io.Writer, stop <-chan struct{}, mutex *sync.Mutex) {
+var (
+	errTooManyReadErrors = errors.New("too many errors reading from camera")
+	errCameraBusy        = errors.New("camera is busy")
+	errCameraExited      = errors.New("camera exited")
+	errInvalidOptions    = errors.New("invalid camera options")
+)
+
+// Messages printed on stderr by raspivid and libcamera-vid when the camera is held by another process
+var cameraBusyMessages = []string{
+	"Device or resource busy",
+	"failed to acquire camera",
+	"Pipeline handler in use by another process",
+	"Out of resources",
+	"failed to enable component: ENOSPC",
+}
+
+// startCamera runs the camera until ctx is cancelled or its output ends.
+// If it fails before producing any output, the fallback configurations are tried in order.
+// It returns an error if the camera couldn't be started or its output couldn't be read.
+func startCamera(ctx context.Context, options CameraOptions, writer io.Writer, mutex *sync.Mutex, clock Clock) error {
 	mutex.Lock()
 	defer mutex.Unlock()
+	if ctx.Err() != nil {
+		// Stopped while waiting for the previous camera to terminate
+		return nil
+	}
 	defer slog.Info("startCamera: Stopped camera")
 
+	if err := options.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidOptions, err)
+	}
+
+	fallbacks := options.Fallbacks
+	for i := 0; ; i++ {
+		output := &outputWatcher{writer: writer}
+		err := runConfiguration(ctx, options, output, clock)
+		if err == nil || ctx.Err() != nil || output.written || i >= len(fallbacks) {
+			return err
+		}
+
+		slog.Warn("startCamera: Camera failed to start; trying fallback", slog.Any("error", err), slog.Int("fallback", i+1))
+		listener := options.OnEvent
+		options = fallbacks[i]
+		options.OnEvent = listener
+	}
+}
+
+// outputWatcher records whether anything was written through it
+type outputWatcher struct {
+	writer  io.Writer
+	written bool
+}
+
+func (w *outputWatcher) Write(p []byte) (int, error) {
+	w.written = true
+	return w.writer.Write(p)
+}
+
+// runConfiguration runs the camera with a single configuration, retrying while it is busy
+func runConfiguration(ctx context.Context, options CameraOptions, writer io.Writer, clock Clock) error {
+	source := options.Source
+	if source == nil && len(options.PipelineCommand) > 0 {
+		if _, err := exec.LookPath(options.PipelineCommand[0]); err != nil {
+			// Retrying won't install the command
+			return fmt.Errorf("%w: pipeline command: %w", errInvalidOptions, err)
+		}
+		command, args := wrapPriority(options, options.PipelineCommand[0], options.PipelineCommand[1:])
+		source = &commandSource{
+			command:   command,
+			args:      args,
+			configure: options.ConfigureCommand,
+		}
+	} else if source == nil {
+		backend, err := determineBackend(options)
+		if err != nil {
+			// Retrying won't install the command
+			return fmt.Errorf("%w: %w", errInvalidOptions, err)
+		}
+		if err := checkResolution(ctx, options, backend); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidOptions, err)
+		}
+		for _, name := range options.ignoredOptions(backend) {
+			slog.Warn("startCamera: Option not supported by the camera command; ignoring", slog.String("option", name), slog.String("command", string(backend)))
+		}
+		command, args := wrapPriority(options, string(backend), buildArgs(options, backend))
+		source = &commandSource{
+			command:   command,
+			args:      args,
+			configure: options.ConfigureCommand,
+		}
+	}
+
+	retryDelay := time.Duration(options.StartRetryDelay)
+	if retryDelay <= 0 {
+		retryDelay = defaultStartRetryDelay
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := runSource(ctx, source, options, writer, clock)
+		if !errors.Is(err, errCameraBusy) || attempt >= options.StartRetries {
+			return err
+		}
+
+		slog.Warn("startCamera: Camera busy; retrying", slog.Int("attempt", attempt+1), slog.Duration("delay", retryDelay))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-clock.After(retryDelay):
+		}
+	}
+}
+
+// buildArgs returns the arguments of the camera command
+func buildArgs(options CameraOptions, backend Backend) []string {
 	args := []string{
 		"--inline", // H264: Force PPS/SPS header with every I frame
 		"-t", "0",  // Disable timeout
@@ -65,8 +336,33 @@ func startCamera(options CameraOptions, writer io.Writer, stop <-chan struct{},
 		"--width", strconv.Itoa(options.Width),
 		"--height", strconv.Itoa(options.Height),
 		"--framerate", strconv.Itoa(options.Fps),
-		"-n",                    // Do not show a preview window
-		"--profile", "baseline", // H264 profile
+	}
+
+	switch {
+	case options.Codec == codecYUV420:
+		args = append(args, "--codec", "yuv420")
+	case options.Codec == CodecLibav && backend.supports("Codec"):
+		args = append(args, "--codec", "libav", "--libav-format", "h264")
+		if options.LibavCodecOptions != "" {
+			args = append(args, "--libav-video-codec-opts", options.LibavCodecOptions)
+		}
+		if options.LowLatency {
+			args = append(args, "--low-latency")
+		}
+	default:
+		args = append(args, "--profile", "baseline") // H264 profile
+	}
+	if options.IntraPeriod > 0 {
+		args = append(args, "--intra", strconv.Itoa(options.IntraPeriod))
+	}
+	if options.Bitrate > 0 {
+		args = append(args, "--bitrate", strconv.Itoa(options.Bitrate))
+	}
+
+	if !options.Preview {
+		args = append(args, "-n") // Do not show a preview window
+	} else if options.PreviewWidth != 0 && options.PreviewHeight != 0 {
+		args = append(args, "--preview", fmt.Sprintf("%d,%d,%d,%d", options.PreviewX, options.PreviewY, options.PreviewWidth, options.PreviewHeight))
 	}
 
 	if options.HorizontalFlip {
@@ -79,84 +375,87 @@ func startCamera(options CameraOptions, writer io.Writer, stop <-chan struct{},
 		args = append(args, "--rotation")
 		args = append(args, strconv.Itoa(options.Rotation))
 	}
+	if options.TuningFile != "" && backend.supports("TuningFile") {
+		args = append(args, "--tuning-file", options.TuningFile)
+	}
 
-	command := determineCameraCommand(options)
+	return args
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	cmd := exec.CommandContext(ctx, command, args...)
-	defer cmd.Wait()
-	defer cancel()
+var readErrorLog = NewLogLimiter(RepeatedLogInterval)
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		slog.Error("startCamera: Error getting stdout pipe", slog.Any("error", err))
-		return
+// readCamera reads the output of the camera until ctx is cancelled or the output ends
+func readCamera(ctx context.Context, stdout io.Reader, options CameraOptions, writer io.Writer, clock Clock) error {
+	if options.QueueSize > 0 {
+		queue := newNALQueue(writer, options.QueueSize)
+		done := make(chan struct{})
+		go func() {
+			queue.run()
+			close(done)
+		}()
+		defer func() {
+			queue.close()
+			<-done
+		}()
+		writer = queue
 	}
-	if err := cmd.Start(); err != nil {
-		slog.Error("startCamera: Error starting camera", slog.Any("error", err))
-		return
+	if options.NALFilter != nil {
+		writer = filterWriter{filter: options.NALFilter, writer: writer}
+	}
+	if options.OnEvent != nil {
+		writer = keyframeEventWriter{listener: options.OnEvent, writer: writer, clock: clock}
+	}
+	if options.NALStatsInterval > 0 {
+		// Count the units as produced by the camera, before filtering
+		stats := &nalStats{writer: writer}
+		statsCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go stats.run(statsCtx, time.Duration(options.NALStatsInterval), clock)
+		writer = stats
+	}
+	var watchdog *frozenWatchdog
+	if options.FrozenTimeout > 0 && options.Source == nil {
+		watchdog = newFrozenWatchdog(writer, options, clock)
+		writer = watchdog
 	}
-	slog.Debug("startCamera: Started camera", slog.String("command", command), slog.Any("args", args))
 
-	p := make([]byte, readBufferSize)
-	buffer := make([]byte, bufferSizeKB*1024)
-	currentPos := 0
-	NALlen := len(nalSeparator)
+	size := options.ReadBufferSize
+	if size <= 0 {
+		size = readBufferSize
+	}
+	p := make([]byte, size)
+	splitter := newNALSplitter(options.Splitter, writer, options.nalBufferSize())
+	readErrors := 0
 
 	for {
 		select {
-		case <-stop:
+		case <-ctx.Done():
 			slog.Debug("startCamera: Stop requested")
-			return
+			return nil
 		default:
 			n, err := stdout.Read(p)
 			if err != nil {
 				if err == io.EOF {
-					slog.Debug("startCamera: EOF", slog.String("command", command))
-					return
+					slog.Debug("startCamera: EOF")
+					return nil
+				}
+				if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+					// Interrupted or not ready: benign, retry
+					continue
+				}
+				readErrors++
+				if readErrors >= maxReadErrors {
+					return fmt.Errorf("%w: %w", errTooManyReadErrors, err)
 				}
-				slog.Error("startCamera: Error reading from camera; ignoring", slog.Any("error", err))
+				readErrorLog.Log(slog.LevelError, "startCamera: Error reading from camera; retrying", slog.Any("error", err), slog.Int("errors", readErrors))
 				continue
 			}
+			readErrors = 0
 
-			copied := copy(buffer[currentPos:], p[:n])
-			startPosSearch := currentPos - NALlen
-			endPos := currentPos + copied
-
-			if startPosSearch < 0 {
-				startPosSearch = 0
-			}
-			nalIndex := bytes.Index(buffer[startPosSearch:endPos], nalSeparator)
-
-			currentPos = endPos
-			if nalIndex > 0 {
-				nalIndex += startPosSearch
-
-				// Boadcast before the NAL
-				broadcast := make([]byte, nalIndex)
-				copy(broadcast, buffer)
-				writer.Write(broadcast)
-
-				// Shift
-				copy(buffer, buffer[nalIndex:currentPos])
-				currentPos = currentPos - nalIndex
+			splitter.Write(p[:n])
+			if watchdog != nil && watchdog.frozen {
+				return errFrozenFrame
 			}
 		}
 	}
 }
-
-func determineCameraCommand(options CameraOptions) string {
-	if options.AutoDetectLibCamera {
-		_, err := exec.LookPath(libcameraCommand)
-		if err == nil {
-			return libcameraCommand
-		}
-		return legacyCommand
-	}
-
-	if options.UseLibcamera {
-		return libcameraCommand
-	} else {
-		return legacyCommand
-	}
-}
@@ -0,0 +1,214 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// argValue returns the value following flag in args, and whether the flag is present
+func argValue(args []string, flag string) (string, bool) {
+	i := slices.Index(args, flag)
+	if i < 0 || i+1 >= len(args) {
+		return "", false
+	}
+	return args[i+1], true
+}
+
+func TestTuningFile(t *testing.T) {
+	tuningFile := filepath.Join(t.TempDir(), "imx219_noir.json")
+	if err := os.WriteFile(tuningFile, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	options := CameraOptions{Width: 640, Height: 480, Fps: 30, TuningFile: tuningFile}
+
+	t.Run("flag", func(t *testing.T) {
+		for _, backend := range []Backend{BackendRpicam, BackendLibcamera} {
+			if value, ok := argValue(buildArgs(options, backend), "--tuning-file"); !ok || value != tuningFile {
+				t.Errorf("%s: --tuning-file %q, present %v", backend, value, ok)
+			}
+		}
+		// raspivid has no tuning files
+		if _, ok := argValue(buildArgs(options, BackendRaspivid), "--tuning-file"); ok {
+			t.Error("raspivid: --tuning-file passed")
+		}
+		if _, ok := argValue(buildArgs(CameraOptions{Width: 640, Height: 480, Fps: 30}, BackendRpicam), "--tuning-file"); ok {
+			t.Error("--tuning-file passed without tuning file")
+		}
+	})
+
+	t.Run("existing file", func(t *testing.T) {
+		if err := options.Validate(); err != nil {
+			t.Errorf("Validate() = %v", err)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		missing := options
+		missing.TuningFile = filepath.Join(t.TempDir(), "missing.json")
+		if err := missing.Validate(); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Validate() = %v, want a missing file error", err)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		options CameraOptions
+		want    []string // Messages of the joined errors, in order
+	}{
+		{
+			name:    "valid",
+			options: CameraOptions{Width: 640, Height: 480, Fps: 30, Rotation: 180},
+		},
+		{
+			name:    "single error",
+			options: CameraOptions{Fps: -1},
+			want:    []string{"fps must not be negative"},
+		},
+		{
+			name: "several errors",
+			options: CameraOptions{
+				Width:          -1,
+				Fps:            -30,
+				Rotation:       45,
+				IntraPeriod:    -1,
+				Codec:          "vp9",
+				ReadBufferSize: -1,
+			},
+			want: []string{
+				"width and height must not be negative",
+				"fps must not be negative",
+				"rotation must be 0, 90, 180 or 270, not 45",
+				"intra period must not be negative",
+				`unknown codec "vp9"`,
+				"read buffer size must not be negative",
+			},
+		},
+		{
+			name: "nested errors",
+			options: CameraOptions{
+				Nice:          30,
+				RestartPolicy: RestartPolicy{Multiplier: 0.5, MaxAttempts: -1},
+				Fallbacks:     []CameraOptions{{}, {Height: -1}},
+			},
+			want: []string{
+				"nice must be between -20 and 19",
+				"restart multiplier must be at least 1\nrestart attempts must not be negative",
+				"fallback 2: width and height must not be negative",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.options.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			joined, ok := err.(interface{ Unwrap() []error })
+			if !ok {
+				t.Fatalf("Validate() = %v, want joined errors", err)
+			}
+			var got []string
+			for _, member := range joined.Unwrap() {
+				got = append(got, member.Error())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Validate() reported:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+// countingReader counts the reads of a reader
+type countingReader struct {
+	reader io.Reader
+	reads  int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.reader.Read(p)
+}
+
+// BenchmarkReadCamera measures the reading of 4 MB of 20 KB NAL units through a pipe, as from the camera,
+// with direct reads of several sizes and with small reads through a bufio.Reader
+func BenchmarkReadCamera(b *testing.B) {
+	nal := append([]byte{0, 0, 0, 1, 0x41}, bytes.Repeat([]byte{0x9a}, 20*1024-5)...)
+	data := bytes.Repeat(nal, 200)
+
+	for _, tt := range []struct {
+		name     string
+		readSize int
+		bufio    bool
+	}{
+		{"4KB", 4096, false},
+		{"64KB", 64 * 1024, false},
+		{"4KB bufio", 4096, true},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			reads := 0
+			for i := 0; i < b.N; i++ {
+				r, w, err := os.Pipe()
+				if err != nil {
+					b.Fatal(err)
+				}
+				go func() {
+					w.Write(data)
+					w.Close()
+				}()
+				counter := &countingReader{reader: r}
+				var stdout io.Reader = counter
+				if tt.bufio {
+					stdout = bufio.NewReaderSize(counter, 64*1024)
+				}
+				err = readCamera(context.Background(), stdout, CameraOptions{ReadBufferSize: tt.readSize}, io.Discard, SystemClock)
+				r.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				reads += counter.reads
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	data := `{"startRetryDelay": "500ms", "frozenTimeout": 2000000000, "restartPolicy": {"maxDelay": "1m"}, "health": {"maxFrameAge": "3s"}}`
+	var options CameraOptions
+	if err := json.Unmarshal([]byte(data), &options); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name      string
+		got, want Duration
+	}{
+		{"string", options.StartRetryDelay, Duration(500 * time.Millisecond)},
+		{"nanoseconds", options.FrozenTimeout, Duration(2 * time.Second)},
+		{"restart policy", options.RestartPolicy.MaxDelay, Duration(time.Minute)},
+		{"health", options.Health.MaxFrameAge, Duration(3 * time.Second)},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{`{"startRetryDelay": "1 second"}`, `{"startRetryDelay": true}`} {
+		if err := json.Unmarshal([]byte(invalid), &options); err == nil {
+			t.Errorf("%s: no error", invalid)
+		}
+	}
+}
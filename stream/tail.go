@@ -0,0 +1,43 @@
+package stream
+
+import (
+	"strings"
+	"sync"
+)
+
+// tailBuffer is a writer keeping the last bytes written to it, used to inspect the stderr of commands
+type tailBuffer struct {
+	mutex sync.Mutex
+	size  int
+	data  []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.data = append(b.data, p...)
+	if len(b.data) > b.size {
+		b.data = b.data[len(b.data)-b.size:]
+	}
+	return len(p), nil
+}
+
+// String returns the bytes kept by the buffer
+func (b *tailBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return string(b.data)
+}
+
+// contains returns true if one of the messages is in the buffer
+func (b *tailBuffer) contains(messages []string) bool {
+	s := b.String()
+	for _, message := range messages {
+		if strings.Contains(s, message) {
+			return true
+		}
+	}
+	return false
+}
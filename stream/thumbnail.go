@@ -0,0 +1,77 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+const thumbnailCacheSizeKB = 1024
+
+// Thumbnailer is a writer receiving the NAL stream and producing a JPEG thumbnail of
+// the latest keyframe at a regular interval, without accessing the camera
+type Thumbnailer struct {
+	cache      *KeyframeCache
+	interval   time.Duration
+	clock      Clock
+	thumbnails chan []byte
+}
+
+// NewThumbnailer creates a thumbnailer producing a thumbnail every interval
+func NewThumbnailer(interval time.Duration) *Thumbnailer {
+	return &Thumbnailer{
+		cache:      NewKeyframeCache(thumbnailCacheSizeKB * 1024),
+		interval:   interval,
+		clock:      SystemClock,
+		thumbnails: make(chan []byte, 1),
+	}
+}
+
+// Write receives a NAL unit of the stream
+func (t *Thumbnailer) Write(nal []byte) (int, error) {
+	t.cache.Add(nal)
+	return len(nal), nil
+}
+
+// Thumbnails returns the channel of the thumbnails. If they are not consumed, only the latest one is kept.
+func (t *Thumbnailer) Thumbnails() <-chan []byte {
+	return t.thumbnails
+}
+
+// Run produces thumbnails until ctx is cancelled. Decoding requires ffmpeg.
+func (t *Thumbnailer) Run(ctx context.Context) {
+	ticker := t.clock.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			thumbnail, err := DecodeJPEG(ctx, t.cache.NALs())
+			if err != nil {
+				if !errors.Is(err, ErrNoKeyframe) && ctx.Err() == nil {
+					slog.Error("Thumbnailer: Error decoding keyframe", slog.Any("error", err))
+				}
+				continue
+			}
+			t.publish(thumbnail)
+		}
+	}
+}
+
+// publish replaces the pending thumbnail, if any, with a new one
+func (t *Thumbnailer) publish(thumbnail []byte) {
+	for {
+		select {
+		case t.thumbnails <- thumbnail:
+			return
+		default:
+		}
+		select {
+		case <-t.thumbnails:
+		default:
+		}
+	}
+}
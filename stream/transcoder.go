@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync/atomic"
+)
+
+const defaultTranscoderQueueSize = 64
+
+// TranscoderOptions configures a Transcoder
+type TranscoderOptions struct {
+	// OutputArgs are the ffmpeg arguments defining the output stream, e.g. VP8 in WebM:
+	// "-c:v", "libvpx", "-deadline", "realtime", "-b:v", "1M", "-f", "webm"
+	OutputArgs []string
+	// QueueSize is the number of NAL units waiting for ffmpeg. When it is full, units are dropped
+	// until the next keyframe, so that a saturated CPU doesn't slow down the camera. Defaults to 64.
+	QueueSize int
+}
+
+// Transcoder is a writer receiving the NAL stream and re-encoding it with ffmpeg to another codec,
+// for clients which can't decode H264. Re-encoding is CPU-heavy: the transcoder only feeds ffmpeg while Run is running,
+// which the application should do while the clients of the alternate stream are connected.
+// The output of ffmpeg is written as is, e.g. to the responses of these clients.
+type Transcoder struct {
+	output  io.Writer
+	args    []string
+	queue   chan []byte
+	running atomic.Bool
+	resync  atomic.Bool // Set when a unit was dropped: ffmpeg must be fed from the next keyframe
+	dropped atomic.Uint64
+}
+
+// NewTranscoder creates a transcoder writing the output of ffmpeg to output
+func NewTranscoder(output io.Writer, options TranscoderOptions) *Transcoder {
+	queueSize := options.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultTranscoderQueueSize
+	}
+	args := []string{"-loglevel", "error", "-fflags", "nobuffer", "-f", "h264", "-i", "-"}
+	args = append(args, options.OutputArgs...)
+	return &Transcoder{
+		output: output,
+		args:   append(args, "-"),
+		queue:  make(chan []byte, queueSize),
+	}
+}
+
+// Write receives a NAL unit of the stream. Units are discarded while Run isn't running.
+// A unit is dropped, without failing, when ffmpeg can't keep up: see WriteDrops.
+func (t *Transcoder) Write(nal []byte) (int, error) {
+	if !t.running.Load() {
+		return len(nal), nil
+	}
+	select {
+	case t.queue <- nal:
+		return len(nal), nil
+	default:
+		t.dropped.Add(1)
+		t.resync.Store(true)
+		return len(nal), nil
+	}
+}
+
+// WriteDrops implements DropCounter
+func (t *Transcoder) WriteDrops() uint64 {
+	return t.dropped.Load()
+}
+
+// DroppedFrames returns the number of NAL units dropped because ffmpeg couldn't keep up
+func (t *Transcoder) DroppedFrames() uint64 {
+	return t.dropped.Load()
+}
+
+// Run transcodes the stream until ctx is cancelled. It returns an error if ffmpeg fails.
+// A single instance of Run must be running at a time.
+func (t *Transcoder) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, decoderCommand, t.args...)
+	cmd.WaitDelay = decoderWaitDelay
+	stderr := &tailBuffer{size: stderrTailSize}
+	cmd.Stdout = t.output
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("transcoder: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("transcoder: %w", err)
+	}
+
+	t.resync.Store(true)
+	t.running.Store(true)
+	defer t.stop()
+	go t.feed(ctx, stdin)
+
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("transcoder: %w: %s", err, stderr)
+	}
+	return nil
+}
+
+// feed writes the queued units to ffmpeg, from a keyframe, until ctx is cancelled or ffmpeg exits
+func (t *Transcoder) feed(ctx context.Context, stdin io.WriteCloser) {
+	defer stdin.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case nal := <-t.queue:
+			if t.resync.Load() {
+				if NALType(nal) != NALTypeSPS {
+					continue
+				}
+				t.resync.Store(false)
+			}
+			if _, err := stdin.Write(nal); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// stop stops queueing units and discards the queued ones
+func (t *Transcoder) stop() {
+	t.running.Store(false)
+	for {
+		select {
+		case <-t.queue:
+		default:
+			return
+		}
+	}
+}
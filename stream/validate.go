@@ -0,0 +1,58 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// maxNALType is the highest NAL unit type defined by H264; the higher ones are unspecified
+const maxNALType = 23
+
+var malformedNALLog = NewLogLimiter(RepeatedLogInterval)
+
+// nalValidator checks the header of the NAL units before writing them to the stats writer,
+// which counts the malformed ones. They are still written: it is a diagnostic aid, not a filter.
+type nalValidator struct {
+	stats *statsWriter
+}
+
+func (v nalValidator) Write(nal []byte) (int, error) {
+	if err := validateNAL(nal); err != nil {
+		count := v.stats.addInvalidNAL()
+		malformedNALLog.Log(slog.LevelWarn, "nalValidator: Malformed NAL unit", slog.Any("error", err), slog.Int("size", len(nal)), slog.Uint64("count", count))
+	}
+	return v.stats.Write(nal)
+}
+
+// validateNAL lightly parses the header of a NAL unit prefixed by its start code
+func validateNAL(nal []byte) error {
+	header := 0
+	if bytes.HasPrefix(nal, nalSeparator) {
+		header = len(nalSeparator)
+	} else if bytes.HasPrefix(nal, shortNALSeparator) {
+		header = len(shortNALSeparator)
+	}
+	if header == 0 {
+		return errors.New("no start code")
+	}
+	if len(nal) <= header {
+		return errors.New("no NAL header")
+	}
+
+	b := nal[header]
+	refIdc := (b >> 5) & 0x03
+	nalType := b & 0x1F
+	switch {
+	case b&0x80 != 0:
+		return errors.New("forbidden_zero_bit is set")
+	case nalType == 0 || nalType > maxNALType:
+		return fmt.Errorf("unspecified NAL unit type %d", nalType)
+	case refIdc == 0 && (nalType == NALTypeIDR || nalType == NALTypeSPS || nalType == NALTypePPS):
+		return fmt.Errorf("NAL unit type %d with nal_ref_idc 0", nalType)
+	case refIdc != 0 && (nalType == NALTypeSEI || nalType == NALTypeAUD):
+		return fmt.Errorf("NAL unit type %d with nal_ref_idc %d", nalType, refIdc)
+	}
+	return nil
+}
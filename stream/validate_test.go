@@ -0,0 +1,74 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestValidateNAL(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		nal   []byte
+		valid bool
+	}{
+		{"SPS", []byte{0, 0, 0, 1, 0x67, 0x42}, true},
+		{"IDR after a short start code", []byte{0, 0, 1, 0x65, 0x88}, true},
+		{"non-reference slice", []byte{0, 0, 0, 1, 0x01, 0x9a}, true},
+		{"SEI", []byte{0, 0, 0, 1, 0x06, 0x05}, true},
+		{"no start code", []byte{0x67, 0x42, 0xc0}, false},
+		{"no header", []byte{0, 0, 0, 1}, false},
+		{"forbidden bit", []byte{0, 0, 0, 1, 0xe5, 0x88}, false},
+		{"type 0", []byte{0, 0, 0, 1, 0x60}, false},
+		{"unspecified type", []byte{0, 0, 0, 1, 0x78}, false},
+		{"IDR with nal_ref_idc 0", []byte{0, 0, 0, 1, 0x05, 0x88}, false},
+		{"PPS with nal_ref_idc 0", []byte{0, 0, 0, 1, 0x08, 0xce}, false},
+		{"AUD with nal_ref_idc", []byte{0, 0, 0, 1, 0x29, 0xf0}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateNAL(tt.nal); (err == nil) != tt.valid {
+				t.Errorf("validateNAL(%x) = %v, want valid %t", tt.nal, err, tt.valid)
+			}
+		})
+	}
+}
+
+// countingWriter reports the size of each write
+type countingWriter struct {
+	written chan int
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	w.written <- len(p)
+	return len(p), nil
+}
+
+func TestCorruptNALsCounted(t *testing.T) {
+	corrupt := bytes.Join([][]byte{
+		{0, 0, 0, 1, 0xe5, 0x88, 0x84}, // forbidden_zero_bit
+		{0, 0, 0, 1, 0x05, 0x88, 0x84}, // IDR with nal_ref_idc 0
+	}, nil)
+	data := append(bytes.Clone(testStream), corrupt...)
+	// Terminates the last corrupt unit
+	data = append(data, 0, 0, 0, 1, 0x09, 0xf0)
+
+	written := make(chan int, 10)
+	options := CameraOptions{Source: &fakeSource{stream: data}, ValidateNALs: true}
+	s := NewStreamer(options, countingWriter{written: written})
+	connections := runStreamer(t, s)
+	connections <- 1
+
+	// The corrupt units are flagged, not dropped
+	total := 0
+	for total < len(data)-6 {
+		select {
+		case n := <-written:
+			total += n
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d bytes written, want %d", total, len(data)-6)
+		}
+	}
+	if invalid := s.Stats().InvalidNALs; invalid != 2 {
+		t.Errorf("Stats().InvalidNALs = %d, want 2", invalid)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/bezineb5/go-h264-streamer/stream"
+)
+
+// ServeTCP accepts connections on the listener and writes the raw H264 stream to each of them,
+// e.g. for gstreamer's tcpclientsrc or ffplay tcp://. Each connection is a subscriber of the same hub
+// as the websocket connections, with the same priming, keyframe wait, backpressure and lag eviction.
+// The NAL units are written without framing. It returns when the listener is closed.
+func (wsh *webSocketHandler) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go wsh.serveTCPConn(conn)
+	}
+}
+
+func (wsh *webSocketHandler) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	if !wsh.track() {
+		return
+	}
+	defer wsh.untrack()
+
+	client := conn.RemoteAddr().String()
+	slog.Debug("tcp: Got connection", slog.String("remote", client))
+	c := &connection{send: make(chan []byte, 10), waitingKeyframe: true, version: ProtocolV0}
+	wsh.register <- c
+	wsh.options.OnEvent.Emit(wsh.clock, stream.Event{Type: stream.EventClientConnected, Client: client})
+	defer func() {
+		wsh.unregister <- c
+		wsh.options.OnEvent.Emit(wsh.clock, stream.Event{Type: stream.EventClientDisconnected, Client: client})
+	}()
+
+	// Clients don't send anything: reading detects the disconnection
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case msg, ok := <-c.send:
+			if !ok {
+				// Removed by the hub
+				return
+			}
+			if _, err := conn.Write(msg); err != nil {
+				slog.Error("tcp: Error writing to connection", slog.Any("error", err))
+				return
+			}
+		case <-wsh.closing:
+			if deadline, ok := wsh.drainDeadline(); ok {
+				conn.SetWriteDeadline(deadline)
+				c.drain(func(msg []byte) error {
+					_, err := conn.Write(msg)
+					return err
+				})
+			}
+			return
+		}
+	}
+}
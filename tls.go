@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ClientCertTLSConfig returns a TLS configuration requiring the clients to present a certificate
+// signed by one of the certificate authorities of the PEM file caPath, for machine-to-machine viewing
+// without tokens. Connections without a valid certificate fail during the TLS handshake.
+func ClientCertTLSConfig(caPath string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("client CA: no certificate found in " + caPath)
+	}
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// hasVerifiedClientCert returns true if the request came over TLS with a client certificate verified against the client CAs
+func hasVerifiedClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
@@ -1,23 +1,221 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"io"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bezineb5/go-h264-streamer/stream"
+
 	"github.com/gorilla/websocket"
 )
 
+const (
+	keyframeCacheSizeKB = 512
+	broadcastTimeout    = 100 * time.Millisecond
+	frameHeaderSize     = 4
+
+	defaultBroadcastQueueSize = 32
+	defaultDispatchWorkers    = 8
+	defaultCoalesceMaxBytes   = 64 * 1024
+
+	keyframePacingChunks  = 8
+	keyframePacingMinSize = 8 * 1024 // Smaller keyframes are sent at once
+
+	pingWriteTimeout = time.Second
+)
+
+// Versions of the framing of the binary messages
+const (
+	ProtocolV0 = 0 // Raw NAL units, as expected by the bundled web player
+	ProtocolV1 = 1 // NAL units prefixed by a 4-byte big-endian sequence number
+)
+
+// protocolVersions maps the websocket subprotocols to the framing versions, in order of preference
+var protocolVersions = []struct {
+	subprotocol string
+	version     int
+}{
+	{"h264-stream.v1", ProtocolV1},
+	{"h264-stream.v0", ProtocolV0},
+}
+
+// BroadcastPolicy defines what happens to a frame written while the broadcast queue is full
+type BroadcastPolicy int
+
+const (
+	// BroadcastBlock waits for room in the queue, slowing down the camera reader
+	BroadcastBlock BroadcastPolicy = iota
+	// BroadcastDrop drops the frame
+	BroadcastDrop
+	// BroadcastDropNonKeyframes drops the frame unless it is needed to start decoding (SPS, PPS, IDR), which waits
+	BroadcastDropNonKeyframes
+)
+
+// WebSocketOptions configures the websocket handler
+type WebSocketOptions struct {
+	// FrameHeader prefixes each binary message with a 4-byte big-endian sequence number,
+	// incremented for every broadcast frame, so that clients can detect lost frames.
+	// Frames sent to prime a new connection have the sequence number 0.
+	// It sets the framing of the clients which don't negotiate a version with a subprotocol:
+	// those requesting "h264-stream.v0" get raw NAL units, and those requesting "h264-stream.v1" get the header.
+	FrameHeader bool
+
+	BroadcastPolicy    BroadcastPolicy // Behavior when the broadcast queue is full. Dropped frames are counted.
+	BroadcastQueueSize int             // Number of frames queued between the camera and the connections. Defaults to 32.
+
+	// Metadata, if set, is sent as a JSON text message to each new connection before any video frame,
+	// so that clients can configure their decoder. Clients only handling binary messages can ignore it.
+	// Its size and frame rate are replaced by those of the latest SPS of the stream, when they are known.
+	Metadata *StreamMetadata
+
+	// DispatchWorkers is the maximum number of slow connections waited for in parallel
+	// when dispatching a frame. Defaults to 8.
+	DispatchWorkers int
+
+	// MaxLag, if set, disconnects the connections whose send buffer has been full for longer,
+	// as they are hopelessly behind the stream
+	MaxLag time.Duration
+
+	// ResponseHeader, if set, returns headers added to the upgrade response, e.g. Set-Cookie, Cache-Control
+	// or custom headers expected by a reverse proxy. The headers negotiating the websocket protocol
+	// (Upgrade, Connection, Sec-WebSocket-Accept, Sec-WebSocket-Extensions) must not be set.
+	// Browsers don't apply CORS to websockets: access control must rely on CheckOrigin or authentication.
+	ResponseHeader func(r *http.Request) http.Header
+
+	// Authorize, if set, is called before upgrading a connection with the request and the identifier
+	// of the stream; the connection is rejected with 403 Forbidden if it returns false.
+	Authorize func(r *http.Request, streamID string) bool
+	// StreamID identifies the stream served by the handler, e.g. the camera name. Defaults to the request path.
+	StreamID string
+
+	// OnEvent, if set, receives the connection and disconnection of clients
+	OnEvent stream.EventListener
+
+	// KeyframeSpread, if set, paces the sending of large keyframe messages (IDR slices, or batches starting with parameter sets) to each connection over this duration,
+	// instead of bursting them, to smooth the bandwidth spikes on constrained links. It delays the keyframes by as much.
+	KeyframeSpread time.Duration
+
+	// MaxConnectionBandwidth and MaxBandwidth, if set, cap the bytes per second sent to each connection
+	// and to all connections together. Over the cap, slices are dropped until the next keyframe,
+	// from which decoding can resume; parameter sets and keyframes are always sent. Drops are counted.
+	MaxConnectionBandwidth int
+	MaxBandwidth           int
+
+	// ConnectionGrace, if set, is how long a new connection must stay connected before it counts
+	// in the number of connections, so that probing or health-check clients don't start the camera.
+	// Connections in their grace period still get the stream if the camera is already running.
+	ConnectionGrace time.Duration
+
+	// CoalesceWindow, if set, batches the consecutive NAL units of an access unit into a single message,
+	// to reduce the framing overhead of streams with many small units. A batch is sent when the next access unit
+	// begins, when it reaches CoalesceMaxBytes (defaults to 64 KB), or at the latest CoalesceWindow after its first unit,
+	// which bounds the added latency. Clients must accept several NAL units per message, as the bundled player does.
+	CoalesceWindow   time.Duration
+	CoalesceMaxBytes int
+
+	// LoadShedding, if set, reduces the load while the broadcast can't keep up with the camera,
+	// so that the stream stays usable instead of stuttering
+	LoadShedding *LoadShedding
+
+	// Placeholder, if set, are the NAL units of a standalone picture (SPS, PPS and IDR slices), loaded with stream.LoadPlaceholder,
+	// sent to new connections while the stream has no keyframe, e.g. while the camera starts,
+	// so that clients show something immediately. The first keyframe of the stream replaces it.
+	Placeholder [][]byte
+
+	// PongTimeout, if set, pings the websocket clients at half this interval, and disconnects those which didn't answer
+	// for this long, instead of counting dead connections until a write to them fails
+	PongTimeout time.Duration
+
+	// DropSEI drops the SEI NAL units (timing or user data) before they reach the clients, for decoders which choke on them.
+	// The other sinks of the stream, e.g. a dump teed with the handler, still receive them.
+	DropSEI bool
+
+	// DrainTimeout, if set, is how long Shutdown keeps sending the messages already queued for each connection
+	// before closing it, so that sessions don't end with truncated frames
+	DrainTimeout time.Duration
+
+	// RequireClientCert rejects the websocket and SSE requests which didn't come over TLS with a verified client certificate,
+	// with 403 Forbidden before upgrading, e.g. as a safeguard when the server is configured with ClientCertTLSConfig.
+	// The TCP clients are authenticated by the TLS configuration of their listener.
+	RequireClientCert bool
+
+	// OnFrame, if set, receives the metadata of each access unit broadcast to the connections, for analytics.
+	// It is called from its own goroutine, once the next access unit begins; the metadata is dropped
+	// if it doesn't keep up, so that it never delays the stream. Nothing is broadcast without connections.
+	// FramePayload adds the NAL units of the access unit to the metadata, at the cost of a copy.
+	OnFrame      func(FrameMeta)
+	FramePayload bool
+
+	// Clock, if set, replaces the time source of the timeouts, bandwidth caps and batching of the handler,
+	// e.g. by a stream.ManualClock in tests. Defaults to stream.SystemClock.
+	Clock stream.Clock
+}
+
+// StreamMetadata describes the stream to the clients.
+// Its JSON form is the "init" command of the bundled web player.
+type StreamMetadata struct {
+	Action string `json:"action"`
+	Codec  string `json:"codec"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Fps    int    `json:"fps"`
+
+	// Version is the framing version of the binary messages of the connection, set for each connection
+	Version int `json:"version"`
+}
+
+// NewStreamMetadata derives the metadata of the stream from the camera options.
+// The handler updates it from the SPS produced by the camera, as the sensor mode may differ from the requested one.
+func NewStreamMetadata(options stream.CameraOptions) *StreamMetadata {
+	width, height := options.Width, options.Height
+	if options.Rotation == 90 || options.Rotation == 270 {
+		width, height = height, width
+	}
+	return &StreamMetadata{
+		Action: "init",
+		Codec:  "h264",
+		Width:  width,
+		Height: height,
+		Fps:    options.Fps,
+	}
+}
+
 type connection struct {
-	ws   *websocket.Conn // The websocket connection.
-	send chan []byte     // Buffered channel of outbound messages.
+	ws        *websocket.Conn // The websocket connection, nil for Server-Sent Events and TCP.
+	send      chan []byte     // Buffered channel of outbound messages.
+	fullSince time.Time       // When send was found full, zero if it had room for the last message.
+	// waitingKeyframe is set until the connection receives a live keyframe: pictures referencing
+	// previous frames can't be decoded before it and would be shown as garbage.
+	waitingKeyframe bool
+	keyframeSpread  time.Duration // Duration over which large IDR slices are sent, 0 to send them at once
+	clock           stream.Clock  // Clock of the hub, pacing the keyframes
+	version         int           // Framing version of the binary messages
+	headerSize      int           // Size of the frame header preceding the NAL unit in messages
+	bandwidth       *tokenBucket  // Bandwidth cap of the connection, nil if unlimited
+	counted         bool          // Set once the connection counts in the number of connections
+
+	lastPong     atomic.Int64 // Time of the latest pong, in Unix nanoseconds of the hub clock, if PongTimeout is set
+	pongTimedOut atomic.Bool  // Set when the websocket was closed because the client stopped answering pings
 }
 
 // WebSocketHandler represents a websocket
 type WebSocketHandler interface {
 	io.Writer
 	Handler(w http.ResponseWriter, r *http.Request)
+	SSEHandler(w http.ResponseWriter, r *http.Request)
+	ServeTCP(listener net.Listener) error
+	Shutdown(ctx context.Context) error
+	DroppedFrames() uint64 // Number of frames dropped by the broadcast policy or the bandwidth caps
+	stream.DropCounter     // Frames dropped by the broadcast policy only, counted in the statistics of the stream
 }
 
 // webSocketHandler main structure
@@ -26,22 +224,79 @@ type webSocketHandler struct {
 	broadcast       chan []byte          // Inbound messages from the connections.
 	register        chan *connection     // Register requests from the connections.
 	unregister      chan *connection     // Unregister requests from connections.
+	qualify         chan *connection     // Connections which stayed connected for the grace period.
 	connectionCount chan int
+	pendingCount    chan int              // Latest number of connections not yet forwarded to connectionCount
+	keyframeCache   *stream.KeyframeCache // Latest SPS/PPS and keyframe, to prime new connections
+	clock           stream.Clock          // Time source for timeouts, from WebSocketOptions.Clock
+	options         WebSocketOptions
+	sequence        uint32 // Sequence number of the last broadcast frame
+	dropped         atomic.Uint64
+	dispatchWorkers int
+	bandwidth       *tokenBucket // Aggregate bandwidth cap, nil if unlimited
+	coalescer       *coalescer   // Batches NAL units into messages, nil if disabled
+
+	shedder   *loadShedder  // Reduces the load under backpressure, nil if disabled
+	overflows atomic.Uint64 // Frames dropped because the broadcast queue was full
+
+	metadata atomic.Pointer[StreamMetadata] // Metadata updated from the SPS, nil if not configured
+	sps      []byte                         // Latest SPS, to parse it only when it changes
+
+	frameMeter *frameMeter // Reports the access units to OnFrame, nil if not set
+
+	registered atomic.Int32 // Number of connections, maintained by the hub for Write, which runs outside of it
+
+	shutdownMutex sync.Mutex
+	shuttingDown  bool
+	closing       chan struct{}  // Closed by Shutdown
+	active        sync.WaitGroup // Connections being served
 }
 
+// Throttled logs of the error paths which can repeat at the frame rate
+var (
+	sendTimeoutLog = stream.NewLogLimiter(stream.RepeatedLogInterval)
+	primeFullLog   = stream.NewLogLimiter(stream.RepeatedLogInterval)
+)
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin:     func(r *http.Request) bool { return true },
+	Subprotocols:    subprotocols(),
+}
+
+func subprotocols() []string {
+	names := make([]string, len(protocolVersions))
+	for i, protocol := range protocolVersions {
+		names[i] = protocol.subprotocol
+	}
+	return names
+}
+
+// protocolVersion returns the framing version of a connection from its negotiated subprotocol
+func (wsh *webSocketHandler) protocolVersion(subprotocol string) int {
+	for _, protocol := range protocolVersions {
+		if protocol.subprotocol == subprotocol {
+			return protocol.version
+		}
+	}
+	if wsh.options.FrameHeader {
+		return ProtocolV1
+	}
+	return ProtocolV0
 }
 
 // handles messages coming from websocket
 func (c *connection) reader(errCh chan bool) {
 	for {
 		messageType, message, err := c.ws.ReadMessage()
-		if err != nil {
-			slog.Error("connection: Error reading message from websocket: ", err)
-			defer func() { errCh <- true }()
+		if err != nil && c.pongTimedOut.Load() {
+			// Already logged by keepAlive
+			errCh <- true
+			return
+		} else if err != nil {
+			slog.Error("connection: Error reading message from websocket", slog.Any("error", err))
+			errCh <- true
 			return
 		}
 
@@ -49,49 +304,181 @@ func (c *connection) reader(errCh chan bool) {
 	}
 }
 
-// handles messages to a connected client
-func (c *connection) writer(errCh chan bool) {
-	for msg := range c.send {
-		err := c.ws.WriteMessage(websocket.BinaryMessage, msg)
-		if err != nil {
-			slog.Error("connection: Error writing message to websocket: ", err)
+// keepAlive pings the client at half the timeout until done is closed. Once no pong was received for timeout,
+// it closes the websocket, which makes the reader fail.
+func (c *connection) keepAlive(timeout time.Duration, clock stream.Clock, done <-chan struct{}) {
+	c.lastPong.Store(clock.Now().UnixNano())
+	c.ws.SetPongHandler(func(string) error {
+		c.lastPong.Store(clock.Now().UnixNano())
+		return nil
+	})
+
+	ticker := clock.NewTicker(timeout / 2)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				if clock.Now().Sub(time.Unix(0, c.lastPong.Load())) >= timeout {
+					slog.Info("connection: No pong received in time; disconnecting")
+					c.pongTimedOut.Store(true)
+					c.ws.Close()
+					return
+				}
+				// A network deadline, in real time
+				if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteTimeout)); err != nil {
+					// The missing pong disconnects the client
+					slog.Debug("connection: Error sending ping", slog.Any("error", err))
+				}
+			}
+		}
+	}()
+}
+
+// handles messages to a connected client, until the handler shuts down
+func (c *connection) writer(errCh chan bool, wsh *webSocketHandler) {
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return
+			}
+			if err := c.write(msg); err != nil {
+				slog.Error("connection: Error writing message to websocket", slog.Any("error", err))
+				errCh <- true
+				return
+			}
+		case <-wsh.closing:
+			if deadline, ok := wsh.drainDeadline(); ok {
+				c.ws.SetWriteDeadline(deadline)
+				c.drain(c.write)
+			}
+			c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(pingWriteTimeout))
 			errCh <- true
-			break
+			return
+		}
+	}
+}
+
+// write sends a message, paced if it is a large keyframe
+func (c *connection) write(msg []byte) error {
+	if c.keyframeSpread > 0 && len(msg) >= c.headerSize+keyframePacingMinSize && stream.IsKeyframe(stream.NALType(msg[c.headerSize:])) {
+		return c.writePaced(msg)
+	}
+	return c.ws.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+// writePaced writes a message in chunks spread over keyframeSpread
+func (c *connection) writePaced(msg []byte) error {
+	w, err := c.ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	chunkSize := (len(msg) + keyframePacingChunks - 1) / keyframePacingChunks
+	pause := c.keyframeSpread / keyframePacingChunks
+	for len(msg) > 0 {
+		chunk := msg[:min(chunkSize, len(msg))]
+		if _, err := w.Write(chunk); err != nil {
+			w.Close()
+			return err
+		}
+		msg = msg[len(chunk):]
+		if len(msg) > 0 {
+			<-c.clock.After(pause)
 		}
 	}
+	return w.Close()
 }
 
 // Echo the data received on the WebSocket.
 // WebSocket handler. It perform user authentication, upgrades connection
 // to websocket and spawns goroutines to handle data transfers.
 func (wsh *webSocketHandler) Handler(w http.ResponseWriter, r *http.Request) {
+	if !wsh.authorize(w, r) {
+		return
+	}
+	if !wsh.track() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer wsh.untrack()
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+	var responseHeader http.Header
+	if wsh.options.ResponseHeader != nil {
+		responseHeader = wsh.options.ResponseHeader(r)
+	}
+
+	ws, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
-		slog.Error("connection: Error upgrading connection to websocket: ", err)
+		slog.Error("connection: Error upgrading connection to websocket", slog.Any("error", err))
 		return
 	}
 	defer ws.Close()
 
 	// we have a initialized websocket connection.
-	c := &connection{ws, make(chan []byte, 10)}
+	c := &connection{ws: ws, send: make(chan []byte, 10), waitingKeyframe: true, keyframeSpread: wsh.options.KeyframeSpread, clock: wsh.clock}
+	c.version = wsh.protocolVersion(ws.Subprotocol())
+	if c.version == ProtocolV1 {
+		c.headerSize = frameHeaderSize
+	}
+
+	if current := wsh.metadata.Load(); current != nil {
+		metadata := *current
+		metadata.Version = c.version
+		if err := ws.WriteJSON(metadata); err != nil {
+			slog.Error("connection: Error sending metadata", slog.Any("error", err))
+			return
+		}
+	}
 
 	slog.Debug("connection: Got connection")
 	// put it in the registration channel for the hub to take it.
 	wsh.register <- c
+	wsh.options.OnEvent.Emit(wsh.clock, stream.Event{Type: stream.EventClientConnected, Client: r.RemoteAddr})
 	// create error channel. It will be used in case of errors to
-	// end the connection
-	errorCh := make(chan bool)
+	// end the connection. Both goroutines may report an error, so it is
+	// buffered to let the second one exit after the handler returned.
+	errorCh := make(chan bool, 2)
 	defer func() {
 		wsh.unregister <- c
+		wsh.options.OnEvent.Emit(wsh.clock, stream.Event{Type: stream.EventClientDisconnected, Client: r.RemoteAddr})
 	}()
+	if wsh.options.PongTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		c.keepAlive(wsh.options.PongTimeout, wsh.clock, done)
+	}
 	// spawn go routing to send/receive data
 	go c.reader(errorCh)
-	go c.writer(errorCh)
+	go c.writer(errorCh, wsh)
 	// wait for errors or connection end
 	<-errorCh
 }
 
+// authorize applies the RequireClientCert and Authorize options to a request. It answers 403 Forbidden and returns false if access is denied.
+func (wsh *webSocketHandler) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if wsh.options.RequireClientCert && !hasVerifiedClientCert(r) {
+		slog.Info("connection: No verified client certificate", slog.String("remote", r.RemoteAddr))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	if wsh.options.Authorize == nil {
+		return true
+	}
+	streamID := wsh.options.StreamID
+	if streamID == "" {
+		streamID = r.URL.Path
+	}
+	if !wsh.options.Authorize(r, streamID) {
+		slog.Info("connection: Access denied", slog.String("stream", streamID), slog.String("remote", r.RemoteAddr))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 // Main worker loop. Three things can happen: (i) we got a new
 // connection from a client. Handler created connection object and
 // sent it in the connections channel. Connection is stored in
@@ -105,57 +492,411 @@ func (wsh *webSocketHandler) run() {
 		select {
 		case c := <-wsh.register:
 			wsh.connections[c] = true
+			wsh.registered.Store(int32(len(wsh.connections)))
+			if wsh.options.MaxConnectionBandwidth > 0 {
+				c.bandwidth = newTokenBucket(wsh.options.MaxConnectionBandwidth, wsh.clock.Now())
+			}
+			wsh.prime(c)
 			slog.Debug("webSocketHandler: Register call", slog.Int("number of connections", len(wsh.connections)))
-			if wsh.connectionCount != nil {
-				wsh.connectionCount <- len(wsh.connections)
+			if wsh.options.ConnectionGrace > 0 {
+				go wsh.qualifyAfterGrace(c)
+			} else {
+				c.counted = true
+				wsh.notifyCount()
 			}
 
-		case c := <-wsh.unregister:
-			if _, ok := wsh.connections[c]; ok {
-				delete(wsh.connections, c)
-				close(c.send)
+		case c := <-wsh.qualify:
+			if wsh.connections[c] {
+				c.counted = true
+				wsh.notifyCount()
 			}
+
+		case c := <-wsh.unregister:
+			wsh.remove(c)
 			slog.Debug("webSocketHandler: Unregister call", slog.Int("number of connections", len(wsh.connections)))
-			if wsh.connectionCount != nil {
-				wsh.connectionCount <- len(wsh.connections)
-			}
 
 		case msg := <-wsh.broadcast:
-			for c := range wsh.connections {
-				select {
-				case c.send <- msg:
-					continue
-				case <-time.After(100 * time.Millisecond):
-					slog.Warn("webSocketHandler: Timeout sending message to connection")
-					// skip message if timeout
-				}
+			if wsh.shedder != nil {
+				wsh.shedder.observe(len(wsh.broadcast)+1, cap(wsh.broadcast))
+			}
+			wsh.keyframeCache.Add(msg)
+			nalType := stream.NALType(msg)
+			if nalType == stream.NALTypeSPS {
+				wsh.updateMetadata(msg)
 			}
+			if wsh.frameMeter != nil {
+				wsh.frameMeter.add(msg, nalType, wsh.clock.Now())
+			}
+			if wsh.coalescer == nil {
+				wsh.send(msg, nalType)
+				continue
+			}
+			before, after := wsh.coalescer.add(msg, nalType, wsh.clock)
+			wsh.sendBatch(before)
+			wsh.sendBatch(after)
+
+		case <-wsh.coalesceDeadline():
+			wsh.sendBatch(wsh.coalescer.flush())
+
+		case <-wsh.shedTick():
+			wsh.shedder.update(wsh.overflows.Load())
+		}
+	}
+}
+
+// send broadcasts a message made of NAL units, whose slices are of type nalType
+func (wsh *webSocketHandler) send(msg []byte, nalType uint8) {
+	wsh.sequence++
+	if wsh.shedder != nil && wsh.shedder.drops(nalType) {
+		for c := range wsh.connections {
+			c.waitingKeyframe = true
+		}
+		return
+	}
+	if !wsh.allowAggregate(msg, nalType) {
+		return
+	}
+	wsh.dispatch(msg, nalType)
+}
+
+func (wsh *webSocketHandler) sendBatch(b *batch) {
+	if b != nil {
+		wsh.send(b.data, b.nalType)
+	}
+}
+
+// coalesceDeadline returns the channel firing when the pending batch must be sent, nil if there is none
+func (wsh *webSocketHandler) coalesceDeadline() <-chan time.Time {
+	if wsh.coalescer == nil {
+		return nil
+	}
+	return wsh.coalescer.deadline
+}
+
+// updateMetadata updates the metadata sent to new connections from an SPS
+func (wsh *webSocketHandler) updateMetadata(sps []byte) {
+	current := wsh.metadata.Load()
+	if current == nil || bytes.Equal(sps, wsh.sps) {
+		return
+	}
+	wsh.sps = bytes.Clone(sps)
+	params, err := stream.ParseSPS(sps)
+	if err != nil {
+		slog.Warn("webSocketHandler: Invalid SPS; metadata not updated", slog.Any("error", err))
+		return
+	}
+	metadata := *current
+	metadata.Width = params.Width
+	metadata.Height = params.Height
+	if params.Fps > 0 {
+		metadata.Fps = int(math.Round(params.Fps))
+	}
+	wsh.metadata.Store(&metadata)
+}
+
+// shedTick returns the channel firing at the end of each load shedding interval, nil if disabled
+func (wsh *webSocketHandler) shedTick() <-chan time.Time {
+	if wsh.shedder == nil {
+		return nil
+	}
+	return wsh.shedder.ticker.C()
+}
+
+// qualifyAfterGrace submits the connection to be counted once the grace period is over
+func (wsh *webSocketHandler) qualifyAfterGrace(c *connection) {
+	<-wsh.clock.After(wsh.options.ConnectionGrace)
+	// The hub ignores the connection if it is gone in the meantime
+	wsh.qualify <- c
+}
+
+// countedConnections returns the number of connections past their grace period
+func (wsh *webSocketHandler) countedConnections() int {
+	n := 0
+	for c := range wsh.connections {
+		if c.counted {
+			n++
+		}
+	}
+	return n
+}
+
+// notifyCount sends the number of connections to the connectionCount channel without blocking the hub:
+// if the receiver is slow, only the latest number is kept. This prevents a burst of connections from
+// stalling registrations, and the camera reader writing to the hub, while the receiver is busy.
+func (wsh *webSocketHandler) notifyCount() {
+	if wsh.connectionCount == nil {
+		return
+	}
+	select {
+	case <-wsh.pendingCount:
+		// Outdated
+	default:
+	}
+	wsh.pendingCount <- wsh.countedConnections()
+}
+
+// forwardCounts forwards the numbers of connections to the connectionCount channel
+func (wsh *webSocketHandler) forwardCounts() {
+	for n := range wsh.pendingCount {
+		wsh.connectionCount <- n
+	}
+}
+
+// remove unregisters a connection and notifies the new number of connections
+func (wsh *webSocketHandler) remove(c *connection) {
+	if _, ok := wsh.connections[c]; ok {
+		delete(wsh.connections, c)
+		wsh.registered.Store(int32(len(wsh.connections)))
+		// Frames still queued are never sent: a large backlog means the client was far behind
+		if unsent := len(c.send); unsent > 0 {
+			slog.Info("webSocketHandler: Connection closed with unsent frames", slog.Int("unsent", unsent))
+		}
+		close(c.send)
+	}
+	if len(wsh.connections) == 0 {
+		// The camera will stop: don't prime the next client with an outdated picture
+		wsh.keyframeCache.Reset()
+	}
+	wsh.notifyCount()
+}
+
+// evict disconnects a connection which can't keep up with the stream
+func (wsh *webSocketHandler) evict(c *connection) {
+	slog.Warn("webSocketHandler: Evicting connection lagging behind", slog.Duration("maxLag", wsh.options.MaxLag))
+	wsh.remove(c)
+	// Closing the websocket makes its reader fail, which ends the handler.
+	// Server-Sent Events and TCP connections end when their send channel is closed.
+	if c.ws != nil {
+		c.ws.Close()
+	}
+}
+
+// allowAggregate applies the aggregate bandwidth cap to a message sent to all the connections.
+// Once a slice is dropped, the connections wait for the next keyframe.
+func (wsh *webSocketHandler) allowAggregate(msg []byte, nalType uint8) bool {
+	if wsh.bandwidth == nil || wsh.bandwidth.allow(len(msg)*len(wsh.connections), wsh.clock.Now(), stream.IsKeyframe(nalType)) {
+		return true
+	}
+	if isSlice(nalType) {
+		for c := range wsh.connections {
+			c.waitingKeyframe = true
 		}
 	}
+	wsh.dropped.Add(1)
+	return false
+}
+
+// isSlice returns true for the slices which can't be decoded without the previous frames
+func isSlice(nalType uint8) bool {
+	return nalType >= stream.NALTypeSlice && nalType < stream.NALTypeIDR
+}
+
+// dispatch sends a message to every connection. Connections with a full send buffer are waited for
+// concurrently, by up to DispatchWorkers goroutines, so that a slow client doesn't delay the others.
+// The dispatch completes before the next message, which keeps the order of the messages of each connection.
+// New connections only receive pictures from the first keyframe on.
+func (wsh *webSocketHandler) dispatch(nal []byte, nalType uint8) {
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, wsh.dispatchWorkers)
+	var framed []byte // The NAL unit with its frame header, built for the first connection needing it
+
+	for c := range wsh.connections {
+		msg := nal
+		if c.version == ProtocolV1 {
+			if framed == nil {
+				framed = withFrameHeader(wsh.sequence, nal)
+			}
+			msg = framed
+		}
+
+		if c.waitingKeyframe {
+			if nalType == stream.NALTypeIDR {
+				c.waitingKeyframe = false
+			} else if isSlice(nalType) {
+				continue
+			}
+		}
+		if c.bandwidth != nil && !c.bandwidth.allow(len(msg), wsh.clock.Now(), stream.IsKeyframe(nalType)) {
+			if isSlice(nalType) {
+				c.waitingKeyframe = true
+			}
+			wsh.dropped.Add(1)
+			continue
+		}
+
+		select {
+		case c.send <- msg:
+			// Fast path: room in the buffer
+			c.fullSince = time.Time{}
+			continue
+		default:
+		}
+
+		if wsh.options.MaxLag > 0 {
+			now := wsh.clock.Now()
+			if c.fullSince.IsZero() {
+				c.fullSince = now
+			} else if now.Sub(c.fullSince) > wsh.options.MaxLag {
+				wsh.evict(c)
+				continue
+			}
+		}
+
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(c *connection, msg []byte) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			select {
+			case c.send <- msg:
+			case <-wsh.clock.After(broadcastTimeout):
+				sendTimeoutLog.Log(slog.LevelWarn, "webSocketHandler: Timeout sending message to connection")
+				// skip message if timeout
+			}
+		}(c, msg)
+	}
+	wg.Wait()
+}
+
+// prime sends the cached parameter sets and latest keyframe to a new connection, or the placeholder
+// if there is no keyframe yet, so that it can display a picture without waiting for the next keyframe
+func (wsh *webSocketHandler) prime(c *connection) {
+	nals := wsh.keyframeCache.NALs()
+	if !hasIDR(nals) && wsh.options.Placeholder != nil {
+		nals = wsh.options.Placeholder
+	}
+	for _, nal := range nals {
+		if c.version == ProtocolV1 {
+			nal = withFrameHeader(0, nal)
+		}
+		select {
+		case c.send <- nal:
+		default:
+			primeFullLog.Log(slog.LevelWarn, "webSocketHandler: Send buffer full while priming connection")
+			return
+		}
+	}
+}
+
+func hasIDR(nals [][]byte) bool {
+	for _, nal := range nals {
+		if stream.NALType(nal) == stream.NALTypeIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// withFrameHeader returns a copy of the frame prefixed by its header
+func withFrameHeader(sequence uint32, data []byte) []byte {
+	frame := make([]byte, frameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame, sequence)
+	copy(frame[frameHeaderSize:], data)
+	return frame
 }
 
 // Send puts message body into the queue of messages that have to be
 // broadcasted to clients.
+// Frames dropped by the broadcast policy, or while there is no client, don't fail: see WriteDrops.
 func (wsh *webSocketHandler) Write(data []byte) (int, error) {
 	// Optimization: don't send if there is no connection
-	if len(wsh.connections) <= 0 {
-		return 0, nil
+	if wsh.registered.Load() <= 0 {
+		return len(data), nil
+	}
+	if wsh.options.DropSEI && stream.NALType(data) == stream.NALTypeSEI {
+		return len(data), nil
+	}
+
+	switch wsh.options.BroadcastPolicy {
+	case BroadcastDrop:
+		return wsh.tryBroadcast(data)
+	case BroadcastDropNonKeyframes:
+		if !stream.IsKeyframe(stream.NALType(data)) {
+			return wsh.tryBroadcast(data)
+		}
 	}
 
 	wsh.broadcast <- data
 	return len(data), nil
 }
 
+// tryBroadcast queues the data for broadcast, or drops it if the queue is full
+func (wsh *webSocketHandler) tryBroadcast(data []byte) (int, error) {
+	select {
+	case wsh.broadcast <- data:
+		return len(data), nil
+	default:
+		wsh.overflows.Add(1)
+		dropped := wsh.dropped.Add(1)
+		slog.Debug("webSocketHandler: Broadcast queue full; dropping frame", slog.Uint64("dropped", dropped))
+		return len(data), nil
+	}
+}
+
+// WriteDrops returns the number of frames dropped because the broadcast queue was full
+func (wsh *webSocketHandler) WriteDrops() uint64 {
+	return wsh.overflows.Load()
+}
+
+// DroppedFrames returns the number of frames dropped because the broadcast queue was full or over a bandwidth cap
+func (wsh *webSocketHandler) DroppedFrames() uint64 {
+	return wsh.dropped.Load()
+}
+
 // NewWebSocketHandler builds new websocket handler to communicate upstream
-func NewWebSocketHandler(connectionCount chan int) WebSocketHandler {
+func NewWebSocketHandler(connectionCount chan int, options WebSocketOptions) WebSocketHandler {
+	queueSize := options.BroadcastQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultBroadcastQueueSize
+	}
+
+	dispatchWorkers := options.DispatchWorkers
+	if dispatchWorkers <= 0 {
+		dispatchWorkers = defaultDispatchWorkers
+	}
+
 	wsh := webSocketHandler{
-		broadcast:       make(chan []byte),
+		broadcast:       make(chan []byte, queueSize),
 		register:        make(chan *connection),
 		unregister:      make(chan *connection),
+		qualify:         make(chan *connection),
+		closing:         make(chan struct{}),
 		connections:     make(map[*connection]bool),
 		connectionCount: connectionCount,
+		pendingCount:    make(chan int, 1),
+		keyframeCache:   stream.NewKeyframeCache(keyframeCacheSizeKB * 1024),
+		clock:           stream.SystemClock,
+		options:         options,
+		dispatchWorkers: dispatchWorkers,
+	}
+	if options.Clock != nil {
+		wsh.clock = options.Clock
+	}
+	if options.Metadata != nil {
+		metadata := *options.Metadata
+		wsh.metadata.Store(&metadata)
+	}
+	if options.MaxBandwidth > 0 {
+		wsh.bandwidth = newTokenBucket(options.MaxBandwidth, wsh.clock.Now())
+	}
+	if options.CoalesceWindow > 0 {
+		maxBytes := options.CoalesceMaxBytes
+		if maxBytes <= 0 {
+			maxBytes = defaultCoalesceMaxBytes
+		}
+		wsh.coalescer = &coalescer{window: options.CoalesceWindow, maxBytes: maxBytes}
+	}
+	if options.LoadShedding != nil {
+		wsh.shedder = newLoadShedder(*options.LoadShedding, wsh.clock)
+	}
+	if options.OnFrame != nil {
+		wsh.frameMeter = newFrameMeter(options.OnFrame, options.FramePayload)
 	}
 
+	if connectionCount != nil {
+		go wsh.forwardCounts()
+	}
 	go wsh.run()
 	return &wsh
 }
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bezineb5/go-h264-streamer/stream"
+)
+
+// receiveTimeout bounds the real wait for a message which must arrive
+const receiveTimeout = 5 * time.Second
+
+var testEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testNAL returns a NAL unit of the given type, prefixed by its start code. The slices are the first of their picture.
+func testNAL(nalType uint8, payload ...byte) []byte {
+	header := nalType
+	if nalType != stream.NALTypeSEI && nalType != stream.NALTypeAUD {
+		header |= 0x60 // nal_ref_idc
+	}
+	nal := []byte{0, 0, 0, 1, header}
+	if nalType == stream.NALTypeSlice || nalType == stream.NALTypeIDR {
+		nal = append(nal, 0x80) // first_mb_in_slice is 0
+	}
+	return append(nal, payload...)
+}
+
+func newTestHub(t testing.TB, options WebSocketOptions) *webSocketHandler {
+	t.Helper()
+	return NewWebSocketHandler(nil, options).(*webSocketHandler)
+}
+
+// connect registers a connection receiving the live stream with a send buffer of the given size
+func connect(wsh *webSocketHandler, buffer int) *connection {
+	c := &connection{send: make(chan []byte, buffer)}
+	wsh.register <- c
+	return c
+}
+
+func receive(t *testing.T, c *connection) []byte {
+	t.Helper()
+	select {
+	case msg := <-c.send:
+		return msg
+	case <-time.After(receiveTimeout):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestBroadcastTimeout(t *testing.T) {
+	clock := stream.NewManualClock(testEpoch)
+	wsh := newTestHub(t, WebSocketOptions{Clock: clock})
+	fast := connect(wsh, 10)
+	stalled := connect(wsh, 1)
+	stalled.send <- []byte("backlog")
+
+	first, second := testNAL(stream.NALTypeIDR, 1), testNAL(stream.NALTypeIDR, 2)
+	wsh.Write(first)
+	if msg := receive(t, fast); string(msg) != string(first) {
+		t.Fatalf("fast connection received %x", msg)
+	}
+
+	// The dispatch of the first frame waits for the stalled connection, which delays the second one
+	clock.WaitForTimers(1)
+	wsh.Write(second)
+	select {
+	case msg := <-fast.send:
+		t.Fatalf("second frame %x received before the timeout", msg)
+	default:
+	}
+
+	clock.Advance(broadcastTimeout)
+	if msg := receive(t, fast); string(msg) != string(second) {
+		t.Fatalf("fast connection received %x", msg)
+	}
+	if msg := <-stalled.send; string(msg) != "backlog" {
+		t.Errorf("stalled connection received %x", msg)
+	}
+}
+
+func TestDroppedFramesDontFailWrite(t *testing.T) {
+	clock := stream.NewManualClock(testEpoch)
+	wsh := newTestHub(t, WebSocketOptions{Clock: clock, BroadcastPolicy: BroadcastDrop, BroadcastQueueSize: 1})
+	var dump bytes.Buffer
+	writer := io.MultiWriter(wsh, &dump)
+
+	// Without clients
+	if _, err := writer.Write(testNAL(stream.NALTypeIDR, 1)); err != nil {
+		t.Fatalf("write without clients: %v", err)
+	}
+
+	stalled := connect(wsh, 1)
+	stalled.send <- []byte("backlog")
+	if _, err := writer.Write(testNAL(stream.NALTypeIDR, 2)); err != nil {
+		t.Fatal(err)
+	}
+	// The dispatch waits for the stalled connection: the next frame fills the queue, and the last one is dropped
+	clock.WaitForTimers(1)
+	for i := byte(3); i <= 4; i++ {
+		if _, err := writer.Write(testNAL(stream.NALTypeIDR, i)); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	if drops := wsh.WriteDrops(); drops != 1 {
+		t.Errorf("%d drops, want 1", drops)
+	}
+	if want := 4 * len(testNAL(stream.NALTypeIDR, 1)); dump.Len() != want {
+		t.Errorf("dump received %d bytes, want %d", dump.Len(), want)
+	}
+	clock.Advance(broadcastTimeout)
+}
+
+// waitFor fails the test if wg isn't done within receiveTimeout
+func waitFor(t *testing.T, wg *sync.WaitGroup, what string) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(receiveTimeout):
+		t.Fatalf("%s stalled", what)
+	}
+}
+
+// waitForCount reads the numbers of connections until it gets want
+func waitForCount(t *testing.T, counts chan int, want int) {
+	t.Helper()
+	timeout := time.After(receiveTimeout)
+	for {
+		select {
+		case n := <-counts:
+			if n == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("number of connections %d never notified", want)
+		}
+	}
+}
+
+func TestRegistrationBurst(t *testing.T) {
+	const clients = 500
+	// Nobody reads the numbers of connections during the burst, as when the streamer is busy starting the camera
+	counts := make(chan int)
+	wsh := NewWebSocketHandler(counts, WebSocketOptions{}).(*webSocketHandler)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		// The camera keeps writing during the burst
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				wsh.Write(testNAL(stream.NALTypeIDR))
+			}
+		}
+	}()
+
+	connections := make([]*connection, clients)
+	var registered sync.WaitGroup
+	for i := range connections {
+		registered.Add(1)
+		go func(i int) {
+			defer registered.Done()
+			c := &connection{send: make(chan []byte, 10)}
+			wsh.register <- c
+			connections[i] = c
+			go func() {
+				for range c.send {
+					// Drained until unregistered
+				}
+			}()
+		}(i)
+	}
+	waitFor(t, &registered, "registration")
+	waitForCount(t, counts, clients)
+
+	var unregistered sync.WaitGroup
+	for _, c := range connections {
+		unregistered.Add(1)
+		go func(c *connection) {
+			defer unregistered.Done()
+			wsh.unregister <- c
+		}(c)
+	}
+	waitFor(t, &unregistered, "unregistration")
+	waitForCount(t, counts, 0)
+}
+
+func TestLaggingConnectionEviction(t *testing.T) {
+	clock := stream.NewManualClock(testEpoch)
+	const maxLag = time.Second
+	wsh := newTestHub(t, WebSocketOptions{Clock: clock, MaxLag: maxLag})
+	healthy := connect(wsh, 10)
+	stalled := connect(wsh, 1)
+	stalled.send <- []byte("backlog") // Never drained
+
+	// sendFrame writes a frame and waits for the healthy connection to receive it
+	sendFrame := func(i byte) {
+		t.Helper()
+		frame := testNAL(stream.NALTypeIDR, i)
+		wsh.Write(frame)
+		if msg := receive(t, healthy); string(msg) != string(frame) {
+			t.Fatalf("healthy connection received %x, want %x", msg, frame)
+		}
+	}
+
+	// The stalled connection is found full, and the dispatch waits for it until the broadcast timeout
+	sendFrame(1)
+	clock.WaitForTimers(1)
+	clock.Advance(broadcastTimeout)
+
+	// Still within the maximum lag
+	sendFrame(2)
+	clock.WaitForTimers(1)
+	clock.Advance(maxLag)
+
+	// Full for longer than the maximum lag: evicted without waiting for it
+	sendFrame(3)
+	sendFrame(4)
+	if _, open := <-stalled.send; !open {
+		t.Fatal("backlog dropped")
+	}
+	if _, open := <-stalled.send; open {
+		t.Fatal("stalled connection not evicted")
+	}
+	if n := wsh.registered.Load(); n != 1 {
+		t.Errorf("%d connections registered after the eviction, want 1", n)
+	}
+}
+
+// received returns the messages buffered for a connection
+func received(c *connection) [][]byte {
+	var msgs [][]byte
+	for {
+		select {
+		case msg := <-c.send:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestNewConnectionsStartWithKeyframe(t *testing.T) {
+	wsh := newTestHub(t, WebSocketOptions{})
+	// The probe receives every unit: reading it makes sure a unit was dispatched
+	probe := connect(wsh, 100)
+	write := func(nals ...[]byte) {
+		t.Helper()
+		for _, nal := range nals {
+			wsh.Write(nal)
+			receive(t, probe)
+		}
+	}
+	join := func() *connection {
+		c := &connection{send: make(chan []byte, 100), waitingKeyframe: true}
+		wsh.register <- c
+		return c
+	}
+	sps, pps := testNAL(stream.NALTypeSPS, 0x42), testNAL(stream.NALTypePPS, 0xce)
+	idr1, idr4, idr6 := testNAL(stream.NALTypeIDR, 1), testNAL(stream.NALTypeIDR, 4), testNAL(stream.NALTypeIDR, 6)
+	slice2, slice3, slice5, slice7 := testNAL(stream.NALTypeSlice, 2), testNAL(stream.NALTypeSlice, 3), testNAL(stream.NALTypeSlice, 5), testNAL(stream.NALTypeSlice, 7)
+
+	write(sps, pps, idr1, slice2)
+	// Joins mid-GOP: primed with the cached keyframe, then waits for the next live one
+	early := join()
+	write(slice3, sps, pps, idr4)
+	late := join()
+	write(slice5, idr6, slice7)
+
+	for _, tt := range []struct {
+		name string
+		c    *connection
+		want [][]byte
+	}{
+		{"early", early, [][]byte{sps, pps, idr1, sps, pps, idr4, slice5, idr6, slice7}},
+		{"late", late, [][]byte{sps, pps, idr4, idr6, slice7}},
+	} {
+		got := received(tt.c)
+		if !slices.EqualFunc(got, tt.want, bytes.Equal) {
+			t.Errorf("%s connection received\n%x\nwant\n%x", tt.name, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkDispatch measures the time to dispatch a frame to 20 connections when 4 others are stalled:
+// each stalled connection is waited for until broadcastTimeout. With a single worker, they are waited for
+// one after the other, as before DispatchWorkers existed.
+func BenchmarkDispatch(b *testing.B) {
+	const fast, stalled = 20, 4
+	for _, workers := range []int{1, defaultDispatchWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			wsh := newTestHub(b, WebSocketOptions{DispatchWorkers: workers})
+			var connections []*connection
+			defer func() {
+				b.StopTimer()
+				// The readers return once their send channel is closed
+				for _, c := range connections {
+					wsh.unregister <- c
+				}
+			}()
+			var received sync.WaitGroup
+			received.Add(b.N * fast)
+			for i := 0; i < fast; i++ {
+				c := connect(wsh, 10)
+				connections = append(connections, c)
+				go func() {
+					for range c.send {
+						received.Done()
+					}
+				}()
+			}
+			for i := 0; i < stalled; i++ {
+				c := connect(wsh, 1)
+				c.send <- []byte("backlog")
+				connections = append(connections, c)
+			}
+
+			nal := testNAL(stream.NALTypeSlice, make([]byte, 1024)...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				wsh.Write(nal)
+			}
+			received.Wait()
+		})
+	}
+}
+
+func TestKeyframePacing(t *testing.T) {
+	const spread = 80 * time.Millisecond
+	server, client := dialTestWebsocket(t)
+	clock := stream.NewManualClock(testEpoch)
+	c := &connection{ws: server, keyframeSpread: spread, clock: clock}
+
+	keyframe := testNAL(stream.NALTypeIDR, make([]byte, keyframePacingMinSize)...)
+	written := make(chan error, 1)
+	go func() { written <- c.write(keyframe) }()
+
+	// A pause of the hub clock follows each chunk but the last one
+	for i := 1; i < keyframePacingChunks; i++ {
+		clock.WaitForTimers(1)
+		select {
+		case err := <-written:
+			t.Fatalf("keyframe written after %d chunks: %v", i, err)
+		default:
+		}
+		clock.Advance(spread / keyframePacingChunks)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(receiveTimeout))
+	if _, msg, err := client.ReadMessage(); err != nil || !bytes.Equal(msg, keyframe) {
+		t.Errorf("received %d bytes, error %v; want the keyframe of %d bytes", len(msg), err, len(keyframe))
+	}
+}